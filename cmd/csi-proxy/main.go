@@ -0,0 +1,167 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// csi-proxy runs a fault injecting proxy between the CSI sidecars
+// and a CSI driver. The same binary is also used to program the
+// proxy via its control endpoint, for example with:
+//
+//	kubectl exec <pod> -c csi-proxy -- /csi-proxy set-faults '[{"method": "CreateVolume", "code": "UNAVAILABLE", "count": 2}]'
+//
+// The sanity tests use the "call" command to invoke CSI methods of
+// a driver directly.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kubernetes-csi/csi-e2e/pkg/csiproxy"
+	"k8s.io/klog"
+)
+
+var (
+	endpoint        = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint on which the proxy listens for the sidecars and kubelet")
+	driverEndpoint  = flag.String("driver-endpoint", "unix:///csi/csi-driver.sock", "CSI endpoint of the driver")
+	controlEndpoint = flag.String("control-endpoint", "unix:///csi/csi-proxy.sock", "endpoint for programming the proxy")
+	traceSize       = flag.Int("trace-size", csiproxy.DefaultTraceSize, "maximum number of calls in the trace, 0 disables tracing")
+	callTimeout     = flag.Duration("call-timeout", time.Minute, "timeout for the call command")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  %[1]s [flags]
+    Runs the proxy.
+  %[1]s [flags] set-faults <JSON list of faults>
+  %[1]s [flags] get-faults
+  %[1]s [flags] get-calls
+  %[1]s [flags] get-trace
+  %[1]s [flags] reset-trace
+  %[1]s [flags] reset
+    Talks to the control endpoint of a running proxy.
+  %[1]s [flags] call <full gRPC method> <base64 encoded request>
+    Invokes a method of the driver directly and prints the result.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
+	switch {
+	case flag.NArg() == 0:
+		err = runProxy()
+	case flag.Arg(0) == "call" && flag.NArg() == 3:
+		err = runCall(flag.Arg(1), flag.Arg(2))
+	default:
+		err = runClient(flag.Args())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func runProxy() error {
+	proxy, err := csiproxy.New(*driverEndpoint)
+	if err != nil {
+		return err
+	}
+	defer proxy.Stop()
+	proxy.SetTraceSize(*traceSize)
+
+	control, err := csiproxy.Listen(*controlEndpoint)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(control, proxy.ControlHandler()); err != nil {
+			klog.Fatalf("control endpoint %s: %v", *controlEndpoint, err)
+		}
+	}()
+
+	listener, err := csiproxy.Listen(*endpoint)
+	if err != nil {
+		return err
+	}
+	klog.Infof("forwarding from %s to %s, control endpoint %s", *endpoint, *driverEndpoint, *controlEndpoint)
+	return proxy.Serve(listener)
+}
+
+// runCall prints the result as JSON also when the call failed, so
+// only problems with the arguments cause a non-zero exit code.
+func runCall(method, request string) error {
+	data, err := base64.StdEncoding.DecodeString(request)
+	if err != nil {
+		return fmt.Errorf("decoding request: %v", err)
+	}
+	return printJSON(csiproxy.Invoke(*driverEndpoint, method, data, *callTimeout))
+}
+
+func runClient(args []string) error {
+	client, err := csiproxy.NewClient(*controlEndpoint)
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "set-faults" && len(args) == 2:
+		var faults []csiproxy.Fault
+		if err := json.Unmarshal([]byte(args[1]), &faults); err != nil {
+			return fmt.Errorf("parsing faults: %v", err)
+		}
+		return client.SetFaults(faults)
+	case args[0] == "get-faults" && len(args) == 1:
+		faults, err := client.Faults()
+		if err != nil {
+			return err
+		}
+		return printJSON(faults)
+	case args[0] == "get-calls" && len(args) == 1:
+		calls, err := client.Calls()
+		if err != nil {
+			return err
+		}
+		return printJSON(calls)
+	case args[0] == "get-trace" && len(args) == 1:
+		trace, err := client.Trace()
+		if err != nil {
+			return err
+		}
+		return printJSON(trace)
+	case args[0] == "reset-trace" && len(args) == 1:
+		return client.ResetTrace()
+	case args[0] == "reset" && len(args) == 1:
+		return client.Reset()
+	}
+	usage()
+	os.Exit(2)
+	return nil
+}
+
+func printJSON(obj interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(obj)
+}
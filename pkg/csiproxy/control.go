@@ -0,0 +1,178 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// The paths of the control endpoint:
+// - GET returns the current state as JSON
+// - PUT (only faultsPath) replaces the state
+// - DELETE clears it
+const (
+	faultsPath = "/faults"
+	callsPath  = "/calls"
+	tracePath  = "/trace"
+)
+
+// ControlHandler returns the HTTP handler for the control endpoint.
+func (p *Proxy) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(faultsPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, p.Faults())
+		case http.MethodPut:
+			var faults []Fault
+			if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.SetFaults(faults)
+		case http.MethodDelete:
+			p.SetFaults(nil)
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(callsPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, p.Calls())
+		case http.MethodDelete:
+			p.ResetCalls()
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(tracePath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, p.Trace())
+		case http.MethodDelete:
+			p.ResetTrace()
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Client talks to the control endpoint of a proxy.
+type Client struct {
+	client http.Client
+}
+
+// NewClient creates a client for the control endpoint.
+func NewClient(endpoint string) (*Client, error) {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	return &Client{
+		client: http.Client{
+			Transport: &http.Transport{
+				// The host name in the URLs is ignored.
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, address)
+				},
+			},
+		},
+	}, nil
+}
+
+// SetFaults replaces all faults.
+func (c *Client) SetFaults(faults []Fault) error {
+	data, err := json.Marshal(faults)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, faultsPath, data, nil)
+}
+
+// Faults returns the faults which still apply to some calls.
+func (c *Client) Faults() ([]Fault, error) {
+	var faults []Fault
+	err := c.do(http.MethodGet, faultsPath, nil, &faults)
+	return faults, err
+}
+
+// Calls returns the call statistics.
+func (c *Client) Calls() (map[string]CallStats, error) {
+	var calls map[string]CallStats
+	err := c.do(http.MethodGet, callsPath, nil, &calls)
+	return calls, err
+}
+
+// Trace returns the recorded calls, oldest first.
+func (c *Client) Trace() ([]Call, error) {
+	var trace []Call
+	err := c.do(http.MethodGet, tracePath, nil, &trace)
+	return trace, err
+}
+
+// ResetTrace clears the trace.
+func (c *Client) ResetTrace() error {
+	return c.do(http.MethodDelete, tracePath, nil, nil)
+}
+
+// Reset removes all faults and clears the call statistics. The
+// trace is kept.
+func (c *Client) Reset() error {
+	if err := c.do(http.MethodDelete, faultsPath, nil, nil); err != nil {
+		return err
+	}
+	return c.do(http.MethodDelete, callsPath, nil, nil)
+}
+
+func (c *Client) do(method, path string, body []byte, result interface{}) error {
+	req, err := http.NewRequest(method, "http://csi-proxy"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
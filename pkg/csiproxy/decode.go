@@ -0,0 +1,199 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Redacted replaces the content of secrets in decoded messages.
+const Redacted = "<redacted>"
+
+// messageFields contains the names of the top-level fields of CSI
+// requests and responses which are useful in traces. The field
+// numbers are those of CSI 0.3 (csi.v0), which is what the deployed
+// drivers speak. CSI 1.0 moved some fields, for example in
+// ValidateVolumeCapabilitiesRequest, so traces of 1.0 drivers may
+// show wrong names there and secrets in those requests are not
+// redacted. The names are the ones from CSI 1.0, for example all
+// *_secrets fields are called "secrets" and publish_info is called
+// publish_context. Fields which are not listed here are identified
+// by their number.
+var messageFields = map[string]struct {
+	request, response map[int]string
+}{
+	"CreateVolume": {
+		request:  map[int]string{1: "name", 2: "capacity_range", 3: "volume_capabilities", 4: "parameters", 5: "secrets"},
+		response: map[int]string{1: "volume"},
+	},
+	"DeleteVolume": {
+		request: map[int]string{1: "volume_id", 2: "secrets"},
+	},
+	"ControllerPublishVolume": {
+		request:  map[int]string{1: "volume_id", 2: "node_id", 3: "volume_capability", 4: "readonly", 5: "secrets"},
+		response: map[int]string{1: "publish_context"},
+	},
+	"ControllerUnpublishVolume": {
+		request: map[int]string{1: "volume_id", 2: "node_id", 3: "secrets"},
+	},
+	"NodeStageVolume": {
+		request: map[int]string{1: "volume_id", 2: "publish_context", 3: "staging_target_path", 4: "volume_capability", 5: "secrets"},
+	},
+	"NodeUnstageVolume": {
+		request: map[int]string{1: "volume_id", 2: "staging_target_path"},
+	},
+	"NodePublishVolume": {
+		request: map[int]string{1: "volume_id", 2: "publish_context", 3: "staging_target_path", 4: "target_path", 5: "volume_capability", 6: "readonly", 7: "secrets"},
+	},
+	"NodeUnpublishVolume": {
+		request: map[int]string{1: "volume_id", 2: "target_path"},
+	},
+	"ValidateVolumeCapabilities": {
+		request: map[int]string{1: "volume_id", 2: "volume_capabilities"},
+	},
+	"CreateSnapshot": {
+		request:  map[int]string{1: "source_volume_id", 2: "name", 3: "secrets", 4: "parameters"},
+		response: map[int]string{1: "snapshot"},
+	},
+	"DeleteSnapshot": {
+		request: map[int]string{1: "snapshot_id", 2: "secrets"},
+	},
+	"NodeGetInfo": {
+		response: map[int]string{1: "node_id", 2: "max_volumes_per_node", 3: "accessible_topology"},
+	},
+	"GetPluginInfo": {
+		response: map[int]string{1: "name", 2: "vendor_version"},
+	},
+}
+
+// decodeMessage turns a CSI message into a map from field name (or
+// field number) to value, without knowing the message type. Secrets
+// are redacted. Data that cannot be decoded is returned base64
+// encoded.
+func decodeMessage(method string, data []byte, response bool) map[string]interface{} {
+	fields := messageFields[method].request
+	if response {
+		fields = messageFields[method].response
+	}
+	decoded, err := decodeWire(data)
+	if err != nil {
+		return map[string]interface{}{"raw": base64.StdEncoding.EncodeToString(data)}
+	}
+	message := map[string]interface{}{}
+	for number, value := range decoded {
+		name, ok := fields[number]
+		if !ok {
+			name = strconv.Itoa(number)
+		}
+		if name == "secrets" {
+			value = Redacted
+		}
+		message[name] = value
+	}
+	return message
+}
+
+// decodeWire decodes the protobuf wire format into a map from field
+// number to value. Repeated fields become slices. Length delimited
+// fields are treated as string if they contain printable text, as
+// nested message if they can be decoded as such, and as base64
+// encoded bytes otherwise.
+func decodeWire(data []byte) (map[int]interface{}, error) {
+	fields := map[int]interface{}{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		number, wireType := int(key>>3), key&7
+		if number <= 0 {
+			return nil, fmt.Errorf("invalid field number %d", number)
+		}
+
+		var value interface{}
+		switch wireType {
+		case 0: // varint
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint")
+			}
+			data = data[n:]
+			value = v
+		case 1: // 64 bit
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated fixed64")
+			}
+			value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2: // length delimited
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, fmt.Errorf("invalid length")
+			}
+			bytes := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if isText(bytes) {
+				value = string(bytes)
+			} else if nested, err := decodeWire(bytes); err == nil {
+				message := map[string]interface{}{}
+				for nestedNumber, nestedValue := range nested {
+					message[strconv.Itoa(nestedNumber)] = nestedValue
+				}
+				value = message
+			} else {
+				value = base64.StdEncoding.EncodeToString(bytes)
+			}
+		case 5: // 32 bit
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated fixed32")
+			}
+			value = binary.LittleEndian.Uint32(data)
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", wireType)
+		}
+
+		switch existing := fields[number].(type) {
+		case nil:
+			fields[number] = value
+		case []interface{}:
+			fields[number] = append(existing, value)
+		default:
+			fields[number] = []interface{}{existing, value}
+		}
+	}
+	return fields, nil
+}
+
+// isText checks for UTF-8 text without control characters.
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiproxy
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Fault describes how the proxy handles calls of a CSI method.
+// The different actions are applied in the order in which
+// they are listed here.
+type Fault struct {
+	// Method is compared against the full gRPC method name
+	// (for example, "/csi.v0.Controller/CreateVolume") and
+	// against just the last part of it ("CreateVolume").
+	Method string `json:"method"`
+
+	// Delay is added before handling the call.
+	Delay Duration `json:"delay,omitempty"`
+
+	// Hang blocks the call until the caller gives up.
+	Hang bool `json:"hang,omitempty"`
+
+	// Drop closes the connection of the caller.
+	Drop bool `json:"drop,omitempty"`
+
+	// Code, if not OK, fails the call with that gRPC status code
+	// instead of forwarding it to the driver.
+	Code codes.Code `json:"code,omitempty"`
+
+	// Message is used for the status when failing a call with
+	// Code. A default message is used when empty.
+	Message string `json:"message,omitempty"`
+
+	// Count limits the number of calls that are affected by the
+	// fault. Zero means all calls.
+	Count int `json:"count,omitempty"`
+}
+
+// Matches checks whether the fault applies to the gRPC method.
+func (f Fault) Matches(method string) bool {
+	return f.Method == method ||
+		f.Method == method[strings.LastIndex(method, "/")+1:]
+}
+
+// Duration is a time.Duration which is encoded as string
+// (for example, "10s") in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts strings
+// and plain numbers (nanoseconds).
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var nanoseconds int64
+		if err := json.Unmarshal(data, &nanoseconds); err != nil {
+			return err
+		}
+		*d = Duration(nanoseconds)
+		return nil
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// CallStats counts how often a method was called.
+type CallStats struct {
+	// Calls is the total number of calls.
+	Calls int `json:"calls"`
+	// Faults is the number of calls to which a fault was applied.
+	Faults int `json:"faults"`
+}
+
+// faultState holds the active faults and the call statistics.
+// It is safe for concurrent use.
+type faultState struct {
+	mutex  sync.Mutex
+	faults []Fault
+	hits   []int
+	calls  map[string]CallStats
+}
+
+// setFaults replaces all faults.
+func (s *faultState) setFaults(faults []Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append([]Fault{}, faults...)
+	s.hits = make([]int, len(faults))
+}
+
+// getFaults returns the faults that still apply to some calls.
+func (s *faultState) getFaults() []Fault {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	faults := []Fault{}
+	for i, fault := range s.faults {
+		if fault.Count != 0 {
+			if s.hits[i] >= fault.Count {
+				continue
+			}
+			fault.Count -= s.hits[i]
+		}
+		faults = append(faults, fault)
+	}
+	return faults
+}
+
+// getCalls returns a copy of the call statistics, indexed by the
+// full method name.
+func (s *faultState) getCalls() map[string]CallStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	calls := map[string]CallStats{}
+	for method, stats := range s.calls {
+		calls[method] = stats
+	}
+	return calls
+}
+
+// resetCalls clears the call statistics.
+func (s *faultState) resetCalls() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = nil
+}
+
+// call records a call and returns the first fault which applies
+// to it, if there is one.
+func (s *faultState) call(method string) (Fault, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.calls == nil {
+		s.calls = map[string]CallStats{}
+	}
+	stats := s.calls[method]
+	stats.Calls++
+	defer func() {
+		s.calls[method] = stats
+	}()
+
+	for i, fault := range s.faults {
+		if !fault.Matches(method) ||
+			fault.Count != 0 && s.hits[i] >= fault.Count {
+			continue
+		}
+		s.hits[i]++
+		stats.Faults++
+		return fault, true
+	}
+	return Fault{}, false
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package csiproxy implements a gRPC proxy which sits between the
+// CSI sidecars (and kubelet) and a CSI driver. It forwards all calls
+// unmodified, without having to know the CSI protocol, unless a
+// fault was configured for the method. Then it delays the call,
+// fails it, drops the connection or never responds. All calls are
+// recorded in a trace.
+package csiproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// DefaultTraceSize is the number of calls that are kept in the
+// trace of a new proxy.
+const DefaultTraceSize = 10000
+
+// Proxy forwards gRPC calls to the driver, injects faults and
+// records a trace of all calls.
+type Proxy struct {
+	driver *grpc.ClientConn
+	server *grpc.Server
+	state  faultState
+	trace  traceState
+}
+
+// New creates a proxy which forwards calls to the driver at the
+// endpoint. The connection to the driver gets established in the
+// background.
+func New(driverEndpoint string) (*Proxy, error) {
+	network, address, err := ParseEndpoint(driverEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := grpc.Dial(address,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(address string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(network, address, timeout)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %v", driverEndpoint, err)
+	}
+
+	p := &Proxy{driver: driver}
+	p.trace.max = DefaultTraceSize
+	p.server = grpc.NewServer(
+		grpc.Creds(connCredentials{}),
+		grpc.CustomCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(p.handleCall),
+	)
+	return p, nil
+}
+
+// Serve accepts connections on the listener and returns when the
+// listener fails or the proxy gets stopped.
+func (p *Proxy) Serve(listener net.Listener) error {
+	return p.server.Serve(listener)
+}
+
+// Stop closes all connections.
+func (p *Proxy) Stop() {
+	p.server.Stop()
+	p.driver.Close()
+}
+
+// SetFaults replaces all faults.
+func (p *Proxy) SetFaults(faults []Fault) {
+	p.state.setFaults(faults)
+}
+
+// Faults returns the faults which still apply to some calls.
+func (p *Proxy) Faults() []Fault {
+	return p.state.getFaults()
+}
+
+// Calls returns the statistics for all methods which were called
+// since the proxy started or ResetCalls was called.
+func (p *Proxy) Calls() map[string]CallStats {
+	return p.state.getCalls()
+}
+
+// ResetCalls clears the call statistics.
+func (p *Proxy) ResetCalls() {
+	p.state.resetCalls()
+}
+
+// SetTraceSize changes how many calls are kept in the trace.
+// Zero disables tracing.
+func (p *Proxy) SetTraceSize(max int) {
+	p.trace.mutex.Lock()
+	defer p.trace.mutex.Unlock()
+	p.trace.max = max
+}
+
+// Trace returns the recorded calls, oldest first.
+func (p *Proxy) Trace() []Call {
+	return p.trace.getTrace()
+}
+
+// ResetTrace clears the trace.
+func (p *Proxy) ResetTrace() {
+	p.trace.reset()
+}
+
+// handleCall gets invoked by gRPC for all methods because the proxy
+// does not register any services.
+func (p *Proxy) handleCall(srv interface{}, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	method, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "unknown method")
+	}
+	call := recordedCall{
+		time:   time.Now(),
+		method: method,
+	}
+	if err := stream.RecvMsg(&call.request); err != nil {
+		return err
+	}
+
+	call.err = p.forwardCall(ctx, &call)
+	call.latency = time.Since(call.time)
+	p.trace.record(call)
+	if call.err != nil {
+		return call.err
+	}
+	return stream.SendMsg(&call.response)
+}
+
+// forwardCall applies the faults for the call or forwards it to the
+// driver and stores the response in the call.
+func (p *Proxy) forwardCall(ctx context.Context, call *recordedCall) error {
+	method := call.method
+	if fault, ok := p.state.call(method); ok {
+		klog.V(3).Infof("%s: injecting %+v", method, fault)
+		call.injected = true
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(time.Duration(fault.Delay)):
+			case <-ctx.Done():
+				return contextError(ctx)
+			}
+		}
+		if fault.Hang {
+			<-ctx.Done()
+			return contextError(ctx)
+		}
+		if fault.Drop {
+			if caller, ok := peer.FromContext(ctx); ok {
+				if conn, ok := caller.AuthInfo.(connInfo); ok {
+					conn.Close()
+				}
+			}
+			return status.Error(codes.Unavailable, "connection dropped by csi-proxy")
+		}
+		if fault.Code != codes.OK {
+			message := fault.Message
+			if message == "" {
+				message = fmt.Sprintf("%s injected by csi-proxy", fault.Code)
+			}
+			return status.Error(fault.Code, message)
+		}
+	}
+
+	klog.V(5).Infof("%s: forwarding %d bytes", method, len(call.request))
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	err := p.driver.Invoke(ctx, method, &call.request, &call.response, grpc.CallCustomCodec(rawCodec{}))
+	if err != nil {
+		klog.V(5).Infof("%s: %v", method, err)
+	}
+	return err
+}
+
+// contextError converts the error of a context which is done
+// into the corresponding gRPC status.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return status.Error(codes.Canceled, ctx.Err().Error())
+}
+
+// ParseEndpoint splits an endpoint like unix:///csi/csi.sock or
+// tcp://localhost:1234 into network and address. A plain path is
+// treated as unix domain socket.
+func ParseEndpoint(endpoint string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		return "unix", strings.TrimPrefix(endpoint, "unix://"), nil
+	case strings.HasPrefix(endpoint, "tcp://"):
+		return "tcp", strings.TrimPrefix(endpoint, "tcp://"), nil
+	case strings.Contains(endpoint, "://"):
+		return "", "", fmt.Errorf("unsupported endpoint %q", endpoint)
+	case endpoint == "":
+		return "", "", fmt.Errorf("empty endpoint")
+	}
+	return "unix", endpoint, nil
+}
+
+// Listen creates a listener for the endpoint. A stale unix domain
+// socket gets removed first.
+func Listen(endpoint string) (net.Listener, error) {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("removing %s: %v", address, err)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// rawMessage contains the serialized request or response.
+type rawMessage []byte
+
+// rawCodec passes messages through without decoding them.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(*rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *msg, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*msg = append((*msg)[:0], data...)
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "raw"
+}
+
+// connCredentials does not add any security. It only makes the
+// connection of a call available to handleCall via the AuthInfo in
+// the peer.Peer, so that the connection can be dropped.
+type connCredentials struct{}
+
+// connInfo is the AuthInfo for connCredentials.
+type connInfo struct {
+	net.Conn
+}
+
+func (connInfo) AuthType() string {
+	return "csi-proxy"
+}
+
+func (connCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, connInfo{conn}, nil
+}
+
+func (connCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, connInfo{conn}, nil
+}
+
+func (connCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "csi-proxy"}
+}
+
+func (c connCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (connCredentials) OverrideServerName(string) error {
+	return nil
+}
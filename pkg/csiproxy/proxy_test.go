@@ -0,0 +1,325 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const createVolume = "/csi.v0.Controller/CreateVolume"
+
+// setup starts an echo server as driver, a proxy for it and returns
+// a client connection to the proxy and the proxy itself.
+func setup(t *testing.T) (*grpc.ClientConn, *Proxy, func()) {
+	dir, err := ioutil.TempDir("", "csi-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	driverEndpoint := "unix://" + path.Join(dir, "driver.sock")
+	proxyEndpoint := "unix://" + path.Join(dir, "proxy.sock")
+
+	driverListener, err := Listen(driverEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := grpc.NewServer(
+		grpc.CustomCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			var msg rawMessage
+			if err := stream.RecvMsg(&msg); err != nil {
+				return err
+			}
+			return stream.SendMsg(&msg)
+		}),
+	)
+	go driver.Serve(driverListener)
+
+	proxy, err := New(driverEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyListener, err := Listen(proxyEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve(proxyListener)
+
+	_, address, _ := ParseEndpoint(proxyEndpoint)
+	conn, err := grpc.Dial(address,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(address string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", address, timeout)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, proxy, func() {
+		conn.Close()
+		proxy.Stop()
+		driver.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// call invokes the method with a fixed request and checks the echo.
+// It waits for the connection to be re-established after a drop.
+func call(ctx context.Context, conn *grpc.ClientConn, method string) error {
+	request := rawMessage("hello")
+	var response rawMessage
+	if err := conn.Invoke(ctx, method, &request, &response, grpc.CallCustomCodec(rawCodec{}), grpc.FailFast(false)); err != nil {
+		return err
+	}
+	if string(response) != string(request) {
+		return status.Errorf(codes.Unknown, "unexpected response %q", response)
+	}
+	return nil
+}
+
+func TestProxy(t *testing.T) {
+	tests := map[string]struct {
+		faults []Fault
+		// Expected codes of consecutive calls of CreateVolume.
+		codes []codes.Code
+		// Minimum duration of the first call.
+		delay time.Duration
+	}{
+		"forward": {
+			codes: []codes.Code{codes.OK, codes.OK},
+		},
+		"other method": {
+			faults: []Fault{{Method: "DeleteVolume", Code: codes.Internal}},
+			codes:  []codes.Code{codes.OK},
+		},
+		"error code": {
+			faults: []Fault{{Method: "CreateVolume", Code: codes.Unavailable}},
+			codes:  []codes.Code{codes.Unavailable, codes.Unavailable},
+		},
+		"full method name": {
+			faults: []Fault{{Method: createVolume, Code: codes.Unavailable}},
+			codes:  []codes.Code{codes.Unavailable},
+		},
+		"count": {
+			faults: []Fault{{Method: "CreateVolume", Code: codes.Unavailable, Count: 2}},
+			codes:  []codes.Code{codes.Unavailable, codes.Unavailable, codes.OK},
+		},
+		"multiple faults": {
+			faults: []Fault{
+				{Method: "CreateVolume", Code: codes.Unavailable, Count: 1},
+				{Method: "CreateVolume", Code: codes.ResourceExhausted, Count: 1},
+			},
+			codes: []codes.Code{codes.Unavailable, codes.ResourceExhausted, codes.OK},
+		},
+		"delay": {
+			faults: []Fault{{Method: "CreateVolume", Delay: Duration(100 * time.Millisecond), Count: 1}},
+			codes:  []codes.Code{codes.OK},
+			delay:  100 * time.Millisecond,
+		},
+		"hang": {
+			faults: []Fault{{Method: "CreateVolume", Hang: true, Count: 1}},
+			codes:  []codes.Code{codes.DeadlineExceeded, codes.OK},
+		},
+		"drop": {
+			faults: []Fault{{Method: "CreateVolume", Drop: true, Count: 1}},
+			codes:  []codes.Code{codes.Unavailable, codes.OK},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, proxy, cleanup := setup(t)
+			defer cleanup()
+
+			proxy.SetFaults(test.faults)
+			faults := 0
+			for i, code := range test.codes {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				start := time.Now()
+				err := call(ctx, conn, createVolume)
+				cancel()
+				if i == 0 && time.Since(start) < test.delay {
+					t.Errorf("call returned after %v, expected delay %v", time.Since(start), test.delay)
+				}
+				if status.Code(err) != code {
+					t.Fatalf("call #%d: expected %s, got: %v", i, code, err)
+				}
+				if code != codes.OK {
+					faults++
+				}
+			}
+
+			calls := proxy.Calls()[createVolume]
+			if calls.Calls != len(test.codes) {
+				t.Errorf("expected %d calls, got %+v", len(test.codes), calls)
+			}
+			if test.delay == 0 && calls.Faults != faults {
+				t.Errorf("expected %d faults, got %+v", faults, calls)
+			}
+		})
+	}
+}
+
+func TestControl(t *testing.T) {
+	conn, proxy, cleanup := setup(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "csi-proxy-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	endpoint := "unix://" + path.Join(dir, "control.sock")
+	listener, err := Listen(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, proxy.ControlHandler())
+
+	client, err := NewClient(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fault := Fault{Method: "CreateVolume", Code: codes.Aborted, Delay: Duration(time.Millisecond), Count: 2}
+	if err := client.SetFaults([]Fault{fault}); err != nil {
+		t.Fatalf("set faults: %v", err)
+	}
+	if err := call(context.Background(), conn, createVolume); status.Code(err) != codes.Aborted {
+		t.Fatalf("expected Aborted, got: %v", err)
+	}
+
+	faults, err := client.Faults()
+	if err != nil {
+		t.Fatalf("get faults: %v", err)
+	}
+	fault.Count = 1
+	if len(faults) != 1 || faults[0] != fault {
+		t.Errorf("expected %+v, got %+v", fault, faults)
+	}
+	calls, err := client.Calls()
+	if err != nil {
+		t.Fatalf("get calls: %v", err)
+	}
+	if calls[createVolume] != (CallStats{Calls: 1, Faults: 1}) {
+		t.Errorf("unexpected call stats: %+v", calls)
+	}
+
+	if err := client.Reset(); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if err := call(context.Background(), conn, createVolume); err != nil {
+		t.Fatalf("call after reset: %v", err)
+	}
+	calls, err = client.Calls()
+	if err != nil {
+		t.Fatalf("get calls: %v", err)
+	}
+	if calls[createVolume] != (CallStats{Calls: 1}) {
+		t.Errorf("unexpected call stats after reset: %+v", calls)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	conn, proxy, cleanup := setup(t)
+	defer cleanup()
+
+	// CreateVolumeRequest{name: "pvc-1", secrets: {"key": "secret"}}
+	request := rawMessage("\x0a\x05pvc-1\x2a\x0d\x0a\x03key\x12\x06secret")
+	proxy.SetFaults([]Fault{{Method: "CreateVolume", Code: codes.Unavailable, Count: 1}})
+	for i := 0; i < 2; i++ {
+		var response rawMessage
+		conn.Invoke(context.Background(), createVolume, &request, &response, grpc.CallCustomCodec(rawCodec{}))
+	}
+
+	trace := proxy.Trace()
+	if len(trace) != 2 {
+		t.Fatalf("expected two calls, got: %+v", trace)
+	}
+	for i, call := range trace {
+		if call.ShortMethod() != "CreateVolume" {
+			t.Errorf("call #%d: unexpected method %s", i, call.Method)
+		}
+		if call.Request["name"] != "pvc-1" {
+			t.Errorf("call #%d: unexpected name in request %+v", i, call.Request)
+		}
+		if call.Request["secrets"] != Redacted {
+			t.Errorf("call #%d: secrets not redacted in request %+v", i, call.Request)
+		}
+	}
+	if !trace[0].Injected || !trace[0].Failed() || trace[0].Code != "Unavailable" || trace[0].Response != nil {
+		t.Errorf("unexpected first call: %+v", trace[0])
+	}
+	if trace[1].Injected || trace[1].Failed() {
+		t.Errorf("unexpected second call: %+v", trace[1])
+	}
+	// The echo server returns the request, which gets decoded as
+	// CreateVolumeResponse.
+	if trace[1].Response["volume"] != "pvc-1" {
+		t.Errorf("unexpected response in second call: %+v", trace[1].Response)
+	}
+
+	proxy.SetTraceSize(1)
+	var response rawMessage
+	conn.Invoke(context.Background(), createVolume, &request, &response, grpc.CallCustomCodec(rawCodec{}))
+	if latest := proxy.Trace(); len(latest) != 1 || !latest[0].Time.After(trace[1].Time) {
+		t.Errorf("expected only the latest call after reducing the trace size, got: %+v", latest)
+	}
+	proxy.ResetTrace()
+	if trace := proxy.Trace(); len(trace) != 0 {
+		t.Errorf("expected empty trace after reset, got: %+v", trace)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	conn, proxy, cleanup := setup(t)
+	defer cleanup()
+	endpoint := "unix://" + conn.Target()
+
+	request := Message{}.
+		String(1, "vol").
+		Message(3, Message{}.Message(2, Message{}).Message(3, Message{}.Varint(1, 1))).
+		Map(4, map[string]string{"a": "b"})
+	result := Invoke(endpoint, createVolume, request, 10*time.Second)
+	if result.Code != codes.OK.String() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if result.Response["1"] != "vol" {
+		t.Errorf("expected name vol in echo, got %v", result.Response["1"])
+	}
+	parameter, ok := result.Response["4"].(map[string]interface{})
+	if !ok || parameter["1"] != "a" || parameter["2"] != "b" {
+		t.Errorf("expected parameter a=b in echo, got %v", result.Response["4"])
+	}
+
+	proxy.SetFaults([]Fault{{Method: "CreateVolume", Code: codes.NotFound, Message: "no such volume"}})
+	result = Invoke(endpoint, createVolume, request, 10*time.Second)
+	if result.Code != codes.NotFound.String() || result.Error != "no such volume" {
+		t.Errorf("expected NotFound, got %+v", result)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Call is one gRPC call in the trace of the proxy.
+type Call struct {
+	// Time is when the proxy received the call.
+	Time time.Time `json:"time"`
+	// Method is the full gRPC method name.
+	Method string `json:"method"`
+	// Request and Response are the decoded messages, see
+	// decodeMessage. Response is nil for failed calls.
+	Request  map[string]interface{} `json:"request"`
+	Response map[string]interface{} `json:"response,omitempty"`
+	// Code is the gRPC status code name, "OK" for successful calls.
+	Code string `json:"code"`
+	// Error is the error message of failed calls.
+	Error string `json:"error,omitempty"`
+	// Latency is the time it took to handle the call.
+	Latency Duration `json:"latency"`
+	// Injected is true if a fault was applied to the call.
+	Injected bool `json:"injected,omitempty"`
+}
+
+// ShortMethod returns just the last part of the method name, for
+// example "CreateVolume".
+func (c Call) ShortMethod() string {
+	return c.Method[strings.LastIndex(c.Method, "/")+1:]
+}
+
+// Failed is true for calls which returned an error.
+func (c Call) Failed() bool {
+	return c.Code != codes.OK.String()
+}
+
+// recordedCall is what the proxy stores for each call. Decoding
+// is postponed until the trace gets retrieved.
+type recordedCall struct {
+	time              time.Time
+	method            string
+	request, response rawMessage
+	err               error
+	latency           time.Duration
+	injected          bool
+}
+
+// traceState holds the most recent calls. It is safe for concurrent
+// use.
+type traceState struct {
+	mutex sync.Mutex
+	max   int
+	calls []recordedCall
+}
+
+// record adds a call, dropping the oldest one when the trace is full.
+func (t *traceState) record(call recordedCall) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.max <= 0 {
+		return
+	}
+	if len(t.calls) >= t.max {
+		t.calls = append(t.calls[:0], t.calls[len(t.calls)-t.max+1:]...)
+	}
+	t.calls = append(t.calls, call)
+}
+
+// getTrace decodes all recorded calls.
+func (t *traceState) getTrace() []Call {
+	t.mutex.Lock()
+	recorded := append([]recordedCall{}, t.calls...)
+	t.mutex.Unlock()
+
+	trace := []Call{}
+	for _, call := range recorded {
+		short := call.method[strings.LastIndex(call.method, "/")+1:]
+		c := Call{
+			Time:     call.time,
+			Method:   call.method,
+			Request:  decodeMessage(short, call.request, false),
+			Code:     status.Code(call.err).String(),
+			Latency:  Duration(call.latency),
+			Injected: call.injected,
+		}
+		if call.err != nil {
+			c.Error = status.Convert(call.err).Message()
+		} else {
+			c.Response = decodeMessage(short, call.response, true)
+		}
+		trace = append(trace, c)
+	}
+	return trace
+}
+
+// reset clears the trace.
+func (t *traceState) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.calls = nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csiproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Message builds a protobuf message in wire format. It is used for
+// creating CSI requests without the generated code for CSI. Fields
+// must be added in the order of their numbers.
+type Message []byte
+
+func (m Message) key(number int, wireType uint64) Message {
+	return m.varint(uint64(number)<<3 | wireType)
+}
+
+func (m Message) varint(value uint64) Message {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buffer[:], value)
+	return append(m, buffer[:n]...)
+}
+
+func (m Message) bytes(number int, value []byte) Message {
+	m = m.key(number, 2).varint(uint64(len(value)))
+	return append(m, value...)
+}
+
+// Varint adds an integer, enum or bool field.
+func (m Message) Varint(number int, value uint64) Message {
+	return m.key(number, 0).varint(value)
+}
+
+// Bool adds a bool field.
+func (m Message) Bool(number int, value bool) Message {
+	if !value {
+		return m
+	}
+	return m.Varint(number, 1)
+}
+
+// String adds a string field. Empty strings are not added because
+// that is how proto3 encodes them.
+func (m Message) String(number int, value string) Message {
+	if value == "" {
+		return m
+	}
+	return m.bytes(number, []byte(value))
+}
+
+// Message adds a nested message field. Empty messages are added
+// because they are different from unset fields.
+func (m Message) Message(number int, value Message) Message {
+	return m.bytes(number, value)
+}
+
+// Map adds a map<string, string> field.
+func (m Message) Map(number int, values map[string]string) Message {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m = m.Message(number, Message{}.String(1, key).String(2, values[key]))
+	}
+	return m
+}
+
+// CallResult is the outcome of Invoke.
+type CallResult struct {
+	// Code is the gRPC status code name, "OK" for success.
+	Code string `json:"code"`
+	// Error is the error message of a failed call.
+	Error string `json:"error,omitempty"`
+	// Response is the decoded response of a successful call.
+	// Fields are identified by their number.
+	Response map[string]interface{} `json:"response,omitempty"`
+}
+
+// Invoke calls the gRPC method with the request in wire format.
+func Invoke(endpoint, method string, request []byte, timeout time.Duration) CallResult {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return CallResult{Code: codes.InvalidArgument.String(), Error: err.Error()}
+	}
+	conn, err := grpc.Dial(address,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(address string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(network, address, timeout)
+		}),
+	)
+	if err != nil {
+		return CallResult{Code: codes.Unavailable.String(), Error: err.Error()}
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req := rawMessage(request)
+	var response rawMessage
+	err = conn.Invoke(ctx, method, &req, &response, grpc.CallCustomCodec(rawCodec{}), grpc.FailFast(false))
+	if err != nil {
+		s := status.Convert(err)
+		return CallResult{Code: s.Code().String(), Error: s.Message()}
+	}
+	return CallResult{
+		Code:     codes.OK.String(),
+		Response: decodeMessage("", response, true),
+	}
+}
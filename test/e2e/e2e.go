@@ -17,12 +17,18 @@ limitations under the License.
 package e2e
 
 import (
+	"fmt"
+	"os"
+	"path"
 	"testing"
 	"time"
 
 	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	"github.com/onsi/ginkgo/reporters"
 	"github.com/onsi/gomega"
 
+	"github.com/kubernetes-csi/csi-e2e/test/e2e/storage"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/pkg/version"
@@ -123,6 +129,8 @@ var _ = ginkgo.SynchronizedAfterSuite(func() {
 	// Run on all Ginkgo nodes
 	framework.Logf("Running AfterSuite actions on all node")
 	framework.RunCleanupActions()
+	// The drivers of interrupted tests are gone now.
+	storage.CheckLeaksAfterSuite()
 }, func() {
 	// Run only Ginkgo on node 1
 	framework.Logf("Running AfterSuite actions on node 1")
@@ -133,7 +141,47 @@ var _ = ginkgo.SynchronizedAfterSuite(func() {
 // This function is called on each Ginkgo node in parallel mode.
 func RunE2ETests(t *testing.T) {
 	gomega.RegisterFailHandler(ginkgowrapper.Fail)
-	ginkgo.RunSpecs(t, "Kubernetes CSI E2E suite")
+	if storage.MatrixCompareEnabled() {
+		storage.RunMatrixCompare(t)
+		return
+	}
+	if storage.SoakEnabled() {
+		// Each soak iteration gets its own JUnit file, while
+		// the conformance matrix covers all iterations.
+		iteration := 0
+		var matrix []ginkgo.Reporter
+		if framework.TestContext.ReportDir != "" {
+			matrix = append(matrix, storage.NewMatrixReporter())
+		}
+		storage.RunSoak(t, func(soakReporters []ginkgo.Reporter) bool {
+			iteration++
+			soakReporters = append(soakReporters, junitReporters(fmt.Sprintf("_%03d", iteration))...)
+			soakReporters = append(soakReporters, matrix...)
+			return ginkgo.RunSpecsWithDefaultAndCustomReporters(t, "Kubernetes CSI E2E suite", soakReporters)
+		})
+		return
+	}
+	// Run tests through the Ginkgo runner with output to console + JUnit for CI.
+	reporters := junitReporters("")
+	if framework.TestContext.ReportDir != "" {
+		reporters = append(reporters, storage.NewMatrixReporter())
+	}
+	ginkgo.RunSpecsWithDefaultAndCustomReporters(t, "Kubernetes CSI E2E suite", reporters)
+}
+
+// junitReporters returns a reporter which writes JUnit XML into the
+// report directory, if there is one. The file name contains the
+// report prefix, the Ginkgo node and the suffix.
+func junitReporters(suffix string) []ginkgo.Reporter {
+	if framework.TestContext.ReportDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(framework.TestContext.ReportDir, 0755); err != nil {
+		framework.Logf("Failed creating report directory: %v", err)
+		return nil
+	}
+	fileName := fmt.Sprintf("junit_%v%02d%s.xml", framework.TestContext.ReportPrefix, config.GinkgoConfig.ParallelNode, suffix)
+	return []ginkgo.Reporter{reporters.NewJUnitReporter(path.Join(framework.TestContext.ReportDir, fileName))}
 }
 
 // Run a test container to try and contact the Kubernetes api-server from a pod, wait for it
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type accessModesTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &accessModesTestSuite{}
+
+// initAccessModesTestSuite returns accessModesTestSuite that implements csiTestSuite interface
+func initAccessModesTestSuite() csiTestSuite {
+	return &accessModesTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "access modes",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *accessModesTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *accessModesTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *accessModesTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should share ReadWriteMany volumes between pods on the same node", func() {
+			skipUnlessAccessMode(driver, v1.ReadWriteMany)
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			testSharedWrites(driver, &resource, []string{nodeName, nodeName})
+		})
+
+		It("should share ReadWriteMany volumes between pods on different nodes", func() {
+			skipUnlessAccessMode(driver, v1.ReadWriteMany)
+			nodes := getClientNodes(driver, 2)
+			if len(nodes) < 2 {
+				framework.Skipf("Driver %s is not available on more than one node -- skipping", driver.driverInfo.Name)
+			}
+			testSharedWrites(driver, &resource, nodes)
+		})
+
+		It("should reject writes to ReadOnlyMany volumes on the same node", func() {
+			skipUnlessAccessMode(driver, v1.ReadOnlyMany)
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			testReadOnlyMany(driver, &resource, []string{nodeName, nodeName})
+		})
+
+		It("should reject writes to ReadOnlyMany volumes on different nodes", func() {
+			skipUnlessAccessMode(driver, v1.ReadOnlyMany)
+			nodes := getClientNodes(driver, 2)
+			if len(nodes) < 2 {
+				framework.Skipf("Driver %s is not available on more than one node -- skipping", driver.driverInfo.Name)
+			}
+			testReadOnlyMany(driver, &resource, nodes)
+		})
+
+		It("should fail to provision ReadWriteMany volumes when not supported", func() {
+			if driver.supportsAccessMode(v1.ReadWriteMany) {
+				framework.Skipf("Driver %s supports %s -- skipping", driver.driverInfo.Name, v1.ReadWriteMany)
+			}
+			cs := driver.driverInfo.Config.Framework.ClientSet
+
+			pvc := resource.createClaim("", v1.ReadWriteMany)
+			waitForClaimEvent(cs, pvc, "ProvisioningFailed", framework.ClaimProvisionTimeout)
+		})
+	})
+}
+
+// skipUnlessAccessMode skips the test if the driver does not declare
+// support for the access mode.
+func skipUnlessAccessMode(driver *manifestDriver, mode v1.PersistentVolumeAccessMode) {
+	if !driver.supportsAccessMode(mode) {
+		framework.Skipf("Driver %s doesn't support %s -- skipping", driver.driverInfo.Name, mode)
+	}
+}
+
+// testSharedWrites mounts one ReadWriteMany volume in one pod per
+// node name and checks that each pod sees the files written by all
+// other pods.
+func testSharedWrites(driver *manifestDriver, resource *csiVolumeTestResource, nodeNames []string) {
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+
+	pvc, _ := resource.createBoundClaim("", v1.ReadWriteMany)
+	var pods []*v1.Pod
+	defer func() {
+		for _, pod := range pods {
+			framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+		}
+	}()
+	for _, nodeName := range nodeNames {
+		pod := createPodWithCSIVolume(cs, pvc.Namespace, nodeName, pvc, false)
+		pods = append(pods, pod)
+	}
+
+	for _, pod := range pods {
+		By(fmt.Sprintf("writing from pod %s on node %s", pod.Name, pod.Spec.NodeName))
+		_, stderr, err := f.ExecShellInPodWithFullOutput(pod.Name, fmt.Sprintf("echo %s > %s/%s", pod.Name, podVolumePath, pod.Name))
+		Expect(err).NotTo(HaveOccurred(), "write from pod %s: %s", pod.Name, stderr)
+	}
+	for _, pod := range pods {
+		By(fmt.Sprintf("reading from pod %s on node %s", pod.Name, pod.Spec.NodeName))
+		for _, writer := range pods {
+			stdout, stderr, err := f.ExecShellInPodWithFullOutput(pod.Name, fmt.Sprintf("cat %s/%s", podVolumePath, writer.Name))
+			Expect(err).NotTo(HaveOccurred(), "read file of pod %s: %s", writer.Name, stderr)
+			Expect(stdout).To(Equal(writer.Name), "content of file written by pod %s", writer.Name)
+		}
+	}
+}
+
+// testReadOnlyMany mounts one ReadOnlyMany volume read-only in one pod
+// per node name and checks that writes fail in each of them.
+func testReadOnlyMany(driver *manifestDriver, resource *csiVolumeTestResource, nodeNames []string) {
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+
+	pvc, _ := resource.createBoundClaim("", v1.ReadOnlyMany)
+	var pods []*v1.Pod
+	defer func() {
+		for _, pod := range pods {
+			framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+		}
+	}()
+	for _, nodeName := range nodeNames {
+		pod := createPodWithCSIVolume(cs, pvc.Namespace, nodeName, pvc, true)
+		pods = append(pods, pod)
+	}
+
+	for _, pod := range pods {
+		By(fmt.Sprintf("writing from pod %s on node %s", pod.Name, pod.Spec.NodeName))
+		_, stderr, err := f.ExecShellInPodWithFullOutput(pod.Name, "touch "+podVolumePath+"/file")
+		Expect(err).To(HaveOccurred(), "write into ReadOnlyMany volume should fail")
+		Expect(stderr).To(ContainSubstring("Read-only file system"), "write should fail with EROFS")
+	}
+}
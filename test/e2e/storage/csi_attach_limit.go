@@ -0,0 +1,190 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	volumeutil "k8s.io/kubernetes/pkg/volume/util"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// maxAttachLimit is the highest limit that the attach limit
+	// test is willing to fill up. Drivers with a higher limit
+	// get skipped because the test would take too long.
+	maxAttachLimit = 32
+
+	// attachLimitTimeout is how long the test waits for kubelet to
+	// publish the limit reported by NodeGetInfo in the node status.
+	attachLimitTimeout = 2 * time.Minute
+)
+
+type attachLimitTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &attachLimitTestSuite{}
+
+// initAttachLimitTestSuite returns attachLimitTestSuite that implements csiTestSuite interface
+func initAttachLimitTestSuite() csiTestSuite {
+	return &attachLimitTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name:       "attach limit",
+			featureTag: "[Serial]",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *attachLimitTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *attachLimitTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *attachLimitTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should keep pods pending while the node is at its volume limit", func() {
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			ns := f.Namespace.Name
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			Expect(nodeName).NotTo(BeEmpty(), "driver must be pinned to a node")
+
+			limit := getCSIAttachLimit(cs, nodeName, driver.finalPatchOptions().NewDriverName, driver.attachLimit)
+			if limit <= 0 {
+				framework.Skipf("Driver %s declares no volume limit for node %s -- skipping", driver.driverInfo.Name, nodeName)
+			}
+			if limit > maxAttachLimit {
+				framework.Skipf("Driver %s has a volume limit of %d, more than the %d supported by this test -- skipping", driver.driverInfo.Name, limit, maxAttachLimit)
+			}
+
+			// Pods must go through the scheduler, so they get
+			// pinned with a node selector instead of spec.nodeName.
+			node, err := cs.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			nodeSelector := map[string]string{
+				"kubernetes.io/hostname": node.Labels["kubernetes.io/hostname"],
+			}
+
+			By(fmt.Sprintf("filling node %s with %d volumes", nodeName, limit))
+			var pods []*v1.Pod
+			for i := 0; i < limit; i++ {
+				pvc, _ := resource.createBoundClaim("")
+				pod, err := framework.CreatePod(cs, ns, nodeSelector, []*v1.PersistentVolumeClaim{pvc}, false, "")
+				Expect(err).NotTo(HaveOccurred())
+				pods = append(pods, pod)
+			}
+			defer func() {
+				for _, pod := range pods {
+					framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+				}
+			}()
+
+			By("creating one more pod with a new volume")
+			pvc, _ := resource.createBoundClaim("")
+			extraPod, err := framework.CreateUnschedulablePod(cs, ns, nodeSelector, []*v1.PersistentVolumeClaim{pvc}, false, "")
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				framework.ExpectNoError(framework.DeletePodWithWait(f, cs, extraPod))
+			}()
+
+			By("checking for the scheduling event")
+			eventSelector := fields.Set{
+				"involvedObject.kind":      "Pod",
+				"involvedObject.name":      extraPod.Name,
+				"involvedObject.namespace": ns,
+				"reason":                   "FailedScheduling",
+			}.AsSelector().String()
+			err = framework.WaitTimeoutForPodEvent(cs, extraPod.Name, ns, eventSelector, "exceed max volume count", framework.PodStartTimeout)
+			Expect(err).NotTo(HaveOccurred(), "scheduling event for pod %s", extraPod.Name)
+
+			By("deleting one of the other pods")
+			framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pods[0]))
+			pods = pods[1:]
+
+			By("waiting for the pending pod to start")
+			err = framework.WaitForPodNameRunningInNamespace(cs, extraPod.Name, ns)
+			Expect(err).NotTo(HaveOccurred(), "pod %s should start once a volume slot is free", extraPod.Name)
+		})
+	})
+}
+
+// getCSIAttachLimit returns the configured limit if non-zero. Otherwise
+// it waits for kubelet to publish the limit that the driver reported
+// in NodeGetInfo as allocatable resource of the node and returns that.
+// Zero is returned if the driver doesn't report a limit.
+func getCSIAttachLimit(cs clientset.Interface, nodeName, driverName string, configured int) int {
+	if configured != 0 {
+		return configured
+	}
+
+	key := v1.ResourceName(volumeutil.GetCSIAttachLimitKey(driverName))
+	limit := 0
+	err := wait.PollImmediate(framework.Poll, attachLimitTimeout, func() (bool, error) {
+		node, err := cs.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if value, ok := node.Status.Allocatable[key]; ok {
+			limit = int(value.Value())
+			return true, nil
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		framework.Logf("node %s has no %s allocatable resource", nodeName, key)
+		return 0
+	}
+	Expect(err).NotTo(HaveOccurred())
+	return limit
+}
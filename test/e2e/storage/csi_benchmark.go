@@ -0,0 +1,364 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fioProfile is one fio job. The arguments get combined with the
+// common arguments for file, size and runtime.
+type fioProfile struct {
+	name string
+	args []string
+}
+
+// fioProfiles are the predefined profiles for -csi.benchmark-profiles.
+var fioProfiles = []fioProfile{
+	{"seq-read", []string{"--rw=read", "--bs=1M", "--iodepth=16"}},
+	{"seq-write", []string{"--rw=write", "--bs=1M", "--iodepth=16"}},
+	{"rand-read-4k", []string{"--rw=randread", "--bs=4k", "--iodepth=32"}},
+	{"rand-write-4k", []string{"--rw=randwrite", "--bs=4k", "--iodepth=32"}},
+	{"mixed-4k", []string{"--rw=randrw", "--rwmixread=70", "--bs=4k", "--iodepth=32"}},
+}
+
+func fioProfileNames() []string {
+	var names []string
+	for _, profile := range fioProfiles {
+		names = append(names, profile.name)
+	}
+	return names
+}
+
+// parseFioProfiles turns the -csi.benchmark-profiles value into a
+// list of profiles.
+func parseFioProfiles(value string) ([]fioProfile, error) {
+	var profiles []fioProfile
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if parts := strings.SplitN(entry, ":", 2); len(parts) == 2 {
+			profiles = append(profiles, fioProfile{parts[0], strings.Fields(parts[1])})
+			continue
+		}
+		found := false
+		for _, profile := range fioProfiles {
+			if profile.name == entry {
+				profiles = append(profiles, profile)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown fio profile %q, known are: %s", entry, strings.Join(fioProfileNames(), ", "))
+		}
+	}
+	return profiles, nil
+}
+
+// benchmarkFileSize returns the -csi.benchmark-size in bytes.
+func benchmarkFileSize() (int64, error) {
+	size, err := resource.ParseQuantity(csiTestContext.benchmarkSize)
+	if err != nil {
+		return 0, err
+	}
+	return size.Value(), nil
+}
+
+// fioOutput is the part of fio's JSON output that gets evaluated.
+type fioOutput struct {
+	Version string `json:"fio version"`
+	Jobs    []struct {
+		Read  fioStats `json:"read"`
+		Write fioStats `json:"write"`
+	} `json:"jobs"`
+}
+
+type fioStats struct {
+	// KiB/s.
+	Bandwidth float64 `json:"bw"`
+	IOPS      float64 `json:"iops"`
+	Latency   struct {
+		Mean float64 `json:"mean"`
+	} `json:"lat_ns"`
+}
+
+// benchmarkResult contains the numbers of one fio profile.
+type benchmarkResult struct {
+	Driver     string    `json:"driver"`
+	Profile    string    `json:"profile"`
+	Node       string    `json:"node"`
+	Time       time.Time `json:"time"`
+	FioVersion string    `json:"fioVersion"`
+	// The images of the driver containers, by container name.
+	Images map[string]string `json:"images"`
+
+	ReadIOPS          float64 `json:"readIOPS"`
+	ReadKiBPerSecond  float64 `json:"readKiBPerSecond"`
+	ReadLatencyUs     float64 `json:"readLatencyMicroseconds"`
+	WriteIOPS         float64 `json:"writeIOPS"`
+	WriteKiBPerSecond float64 `json:"writeKiBPerSecond"`
+	WriteLatencyUs    float64 `json:"writeLatencyMicroseconds"`
+}
+
+// runFio runs the profile in a pod with the claim and returns the
+// parsed result.
+func runFio(driver *manifestDriver, pvc *v1.PersistentVolumeClaim, nodeName string, profile fioProfile, size int64) benchmarkResult {
+	cs := driver.driverInfo.Config.Framework.ClientSet
+	direct := "0"
+	if csiTestContext.benchmarkDirectIO {
+		direct = "1"
+	}
+	args := append([]string{
+		"fio",
+		"--name=" + profile.name,
+		"--directory=/mnt/test",
+		"--size=" + strconv.FormatInt(size, 10),
+		"--runtime=" + strconv.Itoa(int(csiTestContext.benchmarkRuntime.Seconds())),
+		"--time_based",
+		"--ioengine=libaio",
+		"--direct=" + direct,
+		"--group_reporting",
+		"--output-format=json",
+		"--output=/tmp/fio.json",
+	}, profile.args...)
+
+	By(fmt.Sprintf("running fio profile %s: %s", profile.name, strings.Join(args, " ")))
+	output := runPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName, v1.Container{
+		Name:    "fio",
+		Image:   csiTestContext.fioImage,
+		Command: []string{"/bin/sh"},
+		Args:    []string{"-c", strings.Join(args, " ") + " && cat /tmp/fio.json && rm -f /mnt/test/" + profile.name + "*"},
+	})
+	var parsed fioOutput
+	// Older fio versions print warnings before the JSON output.
+	start := strings.Index(output, "{")
+	Expect(start).To(BeNumerically(">=", 0), "fio output")
+	err := json.Unmarshal([]byte(output[start:]), &parsed)
+	framework.ExpectNoError(err, "decode fio output")
+	Expect(parsed.Jobs).To(HaveLen(1), "fio jobs")
+	job := parsed.Jobs[0]
+
+	return benchmarkResult{
+		Driver:            driver.driverInfo.Name,
+		Profile:           profile.name,
+		Node:              nodeName,
+		Time:              time.Now(),
+		FioVersion:        parsed.Version,
+		Images:            getDriverImages(driver),
+		ReadIOPS:          job.Read.IOPS,
+		ReadKiBPerSecond:  job.Read.Bandwidth,
+		ReadLatencyUs:     job.Read.Latency.Mean / 1000,
+		WriteIOPS:         job.Write.IOPS,
+		WriteKiBPerSecond: job.Write.Bandwidth,
+		WriteLatencyUs:    job.Write.Latency.Mean / 1000,
+	}
+}
+
+// getDriverImages returns the images of all containers in the driver
+// pods, by container name.
+func getDriverImages(driver *manifestDriver) map[string]string {
+	f := driver.driverInfo.Config.Framework
+	apps := sets.NewString(driver.driverPods.provisioner, driver.driverPods.attacher, driver.driverPods.plugin)
+	pods, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).List(metav1.ListOptions{})
+	framework.ExpectNoError(err, "list driver pods")
+	images := map[string]string{}
+	for _, pod := range pods.Items {
+		if pod.Labels["app"] == "" || !apps.Has(pod.Labels["app"]) {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			images[container.Name] = container.Image
+		}
+	}
+	return images
+}
+
+// saveBenchmarkResults writes the results as JSON and CSV files into
+// the "csi-benchmark" sub-directory of the report directory.
+func saveBenchmarkResults(driver *manifestDriver, results []benchmarkResult) {
+	if framework.TestContext.ReportDir == "" {
+		return
+	}
+	dir := path.Join(framework.TestContext.ReportDir, "csi-benchmark")
+	name := path.Join(dir, fmt.Sprintf("%s-%s", driver.driverInfo.Name, driver.driverInfo.Config.Framework.UniqueName))
+	framework.ExpectNoError(os.MkdirAll(dir, 0755), "create %s", dir)
+
+	data, err := json.MarshalIndent(results, "", "  ")
+	framework.ExpectNoError(err, "encode benchmark results")
+	framework.ExpectNoError(ioutil.WriteFile(name+".json", data, 0644), "write benchmark results")
+
+	file, err := os.Create(name + ".csv")
+	framework.ExpectNoError(err, "create CSV file")
+	defer file.Close()
+	w := csv.NewWriter(file)
+	w.Write([]string{"driver", "profile", "node", "time", "fio version", "images",
+		"read IOPS", "read KiB/s", "read latency us", "write IOPS", "write KiB/s", "write latency us"})
+	for _, r := range results {
+		var images []string
+		for container, image := range r.Images {
+			images = append(images, container+"="+image)
+		}
+		sort.Strings(images)
+		number := func(value float64) string {
+			return strconv.FormatFloat(value, 'f', 1, 64)
+		}
+		w.Write([]string{r.Driver, r.Profile, r.Node, r.Time.Format(time.RFC3339), r.FioVersion, strings.Join(images, " "),
+			number(r.ReadIOPS), number(r.ReadKiBPerSecond), number(r.ReadLatencyUs),
+			number(r.WriteIOPS), number(r.WriteKiBPerSecond), number(r.WriteLatencyUs)})
+	}
+	w.Flush()
+	framework.ExpectNoError(w.Error(), "write CSV file")
+	framework.Logf("benchmark results written to %s.json and %s.csv", name, name)
+}
+
+// compareBenchmarkResults returns all results which are worse than
+// the result for the same driver and profile in the baseline by more
+// than the threshold. Metrics which are zero in the baseline are
+// ignored.
+func compareBenchmarkResults(baseline, results []benchmarkResult, thresholdPercent float64) []string {
+	var regressions []string
+	for _, r := range results {
+		for _, b := range baseline {
+			if b.Driver != r.Driver || b.Profile != r.Profile {
+				continue
+			}
+			check := func(metric string, base, value float64, higherIsBetter bool) {
+				if base == 0 {
+					return
+				}
+				change := (value - base) / base * 100
+				if higherIsBetter && change < -thresholdPercent || !higherIsBetter && change > thresholdPercent {
+					regressions = append(regressions, fmt.Sprintf("%s %s: %s %.1f, baseline %.1f (%+.1f%%)",
+						r.Driver, r.Profile, metric, value, base, change))
+				}
+			}
+			check("read IOPS", b.ReadIOPS, r.ReadIOPS, true)
+			check("read KiB/s", b.ReadKiBPerSecond, r.ReadKiBPerSecond, true)
+			check("read latency us", b.ReadLatencyUs, r.ReadLatencyUs, false)
+			check("write IOPS", b.WriteIOPS, r.WriteIOPS, true)
+			check("write KiB/s", b.WriteKiBPerSecond, r.WriteKiBPerSecond, true)
+			check("write latency us", b.WriteLatencyUs, r.WriteLatencyUs, false)
+		}
+	}
+	return regressions
+}
+
+type benchmarkTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &benchmarkTestSuite{}
+
+// initBenchmarkTestSuite returns benchmarkTestSuite that implements csiTestSuite interface
+func initBenchmarkTestSuite() csiTestSuite {
+	return &benchmarkTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "benchmark",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *benchmarkTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *benchmarkTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if csiTestContext.fioImage == "" {
+		framework.Skipf("Driver %s: benchmark needs -csi.fio-image -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *benchmarkTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should measure the performance with fio", func() {
+			profiles, err := parseFioProfiles(csiTestContext.benchmarkProfiles)
+			framework.ExpectNoError(err, "-csi.benchmark-profiles")
+			var baseline []benchmarkResult
+			if csiTestContext.benchmarkBaseline != "" {
+				data, err := ioutil.ReadFile(csiTestContext.benchmarkBaseline)
+				framework.ExpectNoError(err, "read baseline")
+				framework.ExpectNoError(json.Unmarshal(data, &baseline), "decode baseline %s", csiTestContext.benchmarkBaseline)
+			}
+			size, err := benchmarkFileSize()
+			framework.ExpectNoError(err, "-csi.benchmark-size")
+			nodeName := getClientNodes(driver, 1)[0]
+
+			// Twice the file size leaves room for the
+			// filesystem overhead.
+			pvc, _ := resource.createBoundClaim(strconv.FormatInt(size*2, 10))
+			var results []benchmarkResult
+			for _, profile := range profiles {
+				result := runFio(driver, pvc, nodeName, profile, size)
+				framework.Logf("%s: read %.1f IOPS %.1f KiB/s %.1fus, write %.1f IOPS %.1f KiB/s %.1fus",
+					profile.name, result.ReadIOPS, result.ReadKiBPerSecond, result.ReadLatencyUs,
+					result.WriteIOPS, result.WriteKiBPerSecond, result.WriteLatencyUs)
+				results = append(results, result)
+			}
+			saveBenchmarkResults(driver, results)
+
+			if regressions := compareBenchmarkResults(baseline, results, csiTestContext.benchmarkThreshold); len(regressions) > 0 {
+				framework.Failf("results worse than baseline %s by more than %.1f%%:\n%s",
+					csiTestContext.benchmarkBaseline, csiTestContext.benchmarkThreshold, strings.Join(regressions, "\n"))
+			}
+		})
+	})
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFioProfiles(t *testing.T) {
+	tests := map[string]struct {
+		value    string
+		profiles []fioProfile
+		err      bool
+	}{
+		"empty": {},
+		"predefined": {
+			value: "seq-read, rand-write-4k",
+			profiles: []fioProfile{
+				{"seq-read", []string{"--rw=read", "--bs=1M", "--iodepth=16"}},
+				{"rand-write-4k", []string{"--rw=randwrite", "--bs=4k", "--iodepth=32"}},
+			},
+		},
+		"custom": {
+			value: "small:--rw=write  --bs=512,seq-write",
+			profiles: []fioProfile{
+				{"small", []string{"--rw=write", "--bs=512"}},
+				{"seq-write", []string{"--rw=write", "--bs=1M", "--iodepth=16"}},
+			},
+		},
+		"trailing comma": {
+			value:    "seq-read,",
+			profiles: []fioProfile{{"seq-read", []string{"--rw=read", "--bs=1M", "--iodepth=16"}}},
+		},
+		"unknown": {
+			value: "seq-read,no-such-profile",
+			err:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			profiles, err := parseFioProfiles(test.value)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got profiles %v", profiles)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(profiles, test.profiles) {
+				t.Errorf("expected profiles %v, got: %v", test.profiles, profiles)
+			}
+		})
+	}
+}
+
+func TestCompareBenchmarkResults(t *testing.T) {
+	baseline := []benchmarkResult{
+		{Driver: "hostpath", Profile: "seq-read", ReadIOPS: 100, ReadKiBPerSecond: 1000, ReadLatencyUs: 50},
+		{Driver: "hostpath", Profile: "seq-write", WriteIOPS: 200},
+	}
+	tests := map[string]struct {
+		results     []benchmarkResult
+		regressions []string
+	}{
+		"same": {
+			results: baseline,
+		},
+		"within threshold": {
+			results: []benchmarkResult{
+				{Driver: "hostpath", Profile: "seq-read", ReadIOPS: 91, ReadKiBPerSecond: 1200, ReadLatencyUs: 54},
+			},
+		},
+		"slower": {
+			results: []benchmarkResult{
+				{Driver: "hostpath", Profile: "seq-read", ReadIOPS: 80, ReadKiBPerSecond: 1000, ReadLatencyUs: 60},
+			},
+			regressions: []string{
+				"hostpath seq-read: read IOPS 80.0, baseline 100.0 (-20.0%)",
+				"hostpath seq-read: read latency us 60.0, baseline 50.0 (+20.0%)",
+			},
+		},
+		"no baseline value": {
+			results: []benchmarkResult{
+				{Driver: "hostpath", Profile: "seq-write", WriteIOPS: 200, WriteLatencyUs: 1000},
+			},
+		},
+		"no baseline": {
+			results: []benchmarkResult{
+				{Driver: "hostpath", Profile: "rand-read-4k", ReadIOPS: 1},
+				{Driver: "other", Profile: "seq-read", ReadIOPS: 1},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			regressions := compareBenchmarkResults(baseline, test.results, 10)
+			if !reflect.DeepEqual(regressions, test.regressions) {
+				t.Errorf("expected regressions %q, got: %q", test.regressions, regressions)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// driverCapacity describes which volume sizes a driver supports and
+// how it rounds requested sizes. All sizes are in bytes.
+type driverCapacity struct {
+	// The size of the smallest volume. Smaller requests get
+	// rounded up to it.
+	minimum int64
+	// Sizes get rounded up to a multiple of this. Zero or one
+	// means no rounding.
+	granularity int64
+	// The size of the largest volume. Larger requests must fail
+	// with OutOfRange. Zero if there is no limit.
+	maximum int64
+	// The external-provisioner before v1.0 rounds the size
+	// returned by CreateVolume up to whole Gi when it creates the
+	// PV. 1Gi for drivers deployed with such a provisioner, zero
+	// otherwise.
+	pvGranularity int64
+	// Whether the filesystem inside a pod has the size of the
+	// volume. The hostpath driver uses directories on a shared
+	// filesystem, so its sizes are not enforced.
+	filesystemSize bool
+}
+
+// roundUp returns the expected size of a volume for the requested
+// size.
+func (c driverCapacity) roundUp(request int64) int64 {
+	size := request
+	if size < c.minimum {
+		size = c.minimum
+	}
+	return roundUpTo(size, c.granularity)
+}
+
+// pvSize returns the expected capacity of the PV for the requested
+// size.
+func (c driverCapacity) pvSize(request int64) int64 {
+	return roundUpTo(c.roundUp(request), c.pvGranularity)
+}
+
+func roundUpTo(size, granularity int64) int64 {
+	if granularity > 1 && size%granularity != 0 {
+		size += granularity - size%granularity
+	}
+	return size
+}
+
+const (
+	// The size of the volume filesystem in a pod may be smaller
+	// than the volume because of filesystem overhead, but not by
+	// more than this percentage.
+	filesystemOverheadPercent = 15
+)
+
+type capacityTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &capacityTestSuite{}
+
+// initCapacityTestSuite returns capacityTestSuite that implements csiTestSuite interface
+func initCapacityTestSuite() csiTestSuite {
+	return &capacityTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "capacity",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *capacityTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *capacityTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if driver.capacity == nil {
+		framework.Skipf("Driver %s has no capacity table -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *capacityTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		// testSize provisions a volume with the requested size
+		// and checks the size of the PV and of the filesystem.
+		testSize := func(request int64) {
+			capacity := driver.capacity
+			if capacity.maximum > 0 && request > capacity.maximum {
+				framework.Skipf("Driver %s only supports volumes up to %d bytes -- skipping", driver.driverInfo.Name, capacity.maximum)
+			}
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			volumeSize := capacity.roundUp(request)
+			expected := capacity.pvSize(request)
+
+			pvc, pv := resource.createBoundClaim(strconv.FormatInt(request, 10))
+			By(fmt.Sprintf("checking the size of PV %s for a request of %d bytes", pv.Name, request))
+			size := pv.Spec.Capacity[v1.ResourceStorage]
+			framework.Logf("requested %d bytes, expected %d bytes, got %s", request, expected, size.String())
+			Expect(size.Value()).To(BeNumerically(">=", request), "PV capacity")
+			Expect(size.Value()).To(Equal(expected), "PV capacity after rounding")
+			claimSize := pvc.Status.Capacity[v1.ResourceStorage]
+			Expect(claimSize.Value()).To(Equal(size.Value()), "claim capacity")
+
+			if !capacity.filesystemSize {
+				return
+			}
+			By("checking the size of the filesystem")
+			output := runInPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName, "df -Pk /mnt/test | tail -n 1")
+			fields := strings.Fields(output)
+			Expect(len(fields)).To(BeNumerically(">=", 2), "df output")
+			kib, err := strconv.ParseInt(fields[1], 10, 64)
+			framework.ExpectNoError(err, "filesystem size in df output %q", output)
+			// The filesystem has the size of the volume created
+			// by the driver, which may be smaller than the PV.
+			Expect(kib*1024).To(BeNumerically("<=", volumeSize), "filesystem size")
+			Expect(kib*1024).To(BeNumerically(">=", volumeSize/100*(100-filesystemOverheadPercent)), "filesystem size")
+		}
+
+		It("should round up a request for one byte", func() {
+			testSize(1)
+		})
+
+		It("should provision a request for 1Gi plus one byte", func() {
+			testSize(1024*1024*1024 + 1)
+		})
+
+		It("should provision a request just below the maximum size", func() {
+			if driver.capacity.maximum == 0 {
+				framework.Skipf("Driver %s has no maximum size -- skipping", driver.driverInfo.Name)
+			}
+			testSize(driver.capacity.maximum - 1)
+		})
+
+		It("should reject requests above the maximum size with OutOfRange", func() {
+			if driver.capacity.maximum == 0 {
+				framework.Skipf("Driver %s has no maximum size -- skipping", driver.driverInfo.Name)
+			}
+			cs := driver.driverInfo.Config.Framework.ClientSet
+
+			pvc := resource.createClaim(strconv.FormatInt(driver.capacity.maximum+1, 10))
+			message := waitForClaimEvent(cs, pvc, "ProvisioningFailed", framework.ClaimProvisionTimeout)
+			Expect(message).To(ContainSubstring("OutOfRange"), "ProvisioningFailed event")
+		})
+	})
+}
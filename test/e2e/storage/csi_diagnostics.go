@@ -0,0 +1,282 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	csiv1alpha1 "k8s.io/csi-api/pkg/apis/csi/v1alpha1"
+	"k8s.io/kubernetes/test/e2e/framework"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// diagnosticsBundle writes files into a gzipped tarball. Problems
+// while collecting the content are recorded in errors.txt instead of
+// aborting the collection.
+type diagnosticsBundle struct {
+	tar    *tar.Writer
+	errors []string
+}
+
+func (b *diagnosticsBundle) add(name string, data []byte) {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := b.tar.WriteHeader(header); err != nil {
+		b.failed("write header of %s: %v", name, err)
+		return
+	}
+	if _, err := b.tar.Write(data); err != nil {
+		b.failed("write %s: %v", name, err)
+	}
+}
+
+// addJSON adds a file with the indented JSON encoding of the objects.
+func (b *diagnosticsBundle) addJSON(name string, objects interface{}) {
+	data, err := json.MarshalIndent(objects, "", "  ")
+	if err != nil {
+		b.failed("encode %s: %v", name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+func (b *diagnosticsBundle) failed(format string, args ...interface{}) {
+	b.errors = append(b.errors, fmt.Sprintf(format, args...))
+}
+
+// saveDiagnostics collects the storage state of a failed test into
+// csi-diagnostics/<test>-<unique name>.tar.gz in the report directory:
+// the API objects related to the test namespace and the driver, the
+// description and the most recent log output of the driver pods, and
+// the mount table as seen by the containers of the plugin pod. It does
+// nothing when the test has not failed or the state was already saved
+// for the test.
+func saveDiagnostics(driver *manifestDriver) {
+	if framework.TestContext.ReportDir == "" ||
+		!CurrentGinkgoTestDescription().Failed ||
+		driver.diagnosticsSaved {
+		return
+	}
+	driver.diagnosticsSaved = true
+
+	dir := path.Join(framework.TestContext.ReportDir, "csi-diagnostics")
+	fileName := path.Join(dir, fmt.Sprintf("%s-%s.tar.gz", testFileName(), driver.driverInfo.Config.Framework.UniqueName))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		framework.Logf("creating %s failed: %v", dir, err)
+		return
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		framework.Logf("creating diagnostics bundle failed: %v", err)
+		return
+	}
+	defer file.Close()
+	compressed := gzip.NewWriter(file)
+	defer compressed.Close()
+	b := &diagnosticsBundle{tar: tar.NewWriter(compressed)}
+	defer b.tar.Close()
+
+	collectStorageObjects(driver, b)
+	collectDriverPods(driver, b)
+	if len(b.errors) > 0 {
+		b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n"))
+	}
+	framework.Logf("diagnostics of the failed test written to %s", fileName)
+}
+
+// collectStorageObjects adds the objects which belong to the test
+// namespace or the driver and the events for them.
+func collectStorageObjects(driver *manifestDriver, b *diagnosticsBundle) {
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+	ns := f.Namespace.Name
+	driverName := driver.finalPatchOptions().NewDriverName
+
+	pvcs, err := cs.CoreV1().PersistentVolumeClaims(ns).List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list PVCs: %v", err)
+	} else {
+		b.addJSON("objects/persistentvolumeclaims.json", pvcs.Items)
+	}
+
+	volumeNames := sets.NewString()
+	pvs, err := cs.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list PVs: %v", err)
+	} else {
+		var relevant []v1.PersistentVolume
+		for _, pv := range pvs.Items {
+			if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName ||
+				pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.Namespace == ns {
+				relevant = append(relevant, pv)
+				volumeNames.Insert(pv.Name)
+			}
+		}
+		b.addJSON("objects/persistentvolumes.json", relevant)
+	}
+
+	scs, err := cs.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list StorageClasses: %v", err)
+	} else {
+		var relevant []storagev1.StorageClass
+		for _, sc := range scs.Items {
+			if sc.Provisioner == driverName {
+				relevant = append(relevant, sc)
+			}
+		}
+		b.addJSON("objects/storageclasses.json", relevant)
+	}
+
+	attachments, err := cs.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list VolumeAttachments: %v", err)
+	} else {
+		var relevant []storagev1beta1.VolumeAttachment
+		for _, va := range attachments.Items {
+			if va.Spec.Attacher == driverName {
+				relevant = append(relevant, va)
+			}
+		}
+		b.addJSON("objects/volumeattachments.json", relevant)
+	}
+
+	// The CRDs for these objects are optional.
+	csiDriver, err := f.CSIClientSet.CsiV1alpha1().CSIDrivers().Get(driverName, metav1.GetOptions{})
+	if err != nil {
+		b.failed("get CSIDriver %s: %v", driverName, err)
+	} else {
+		b.addJSON("objects/csidriver.json", csiDriver)
+	}
+	nodeInfos, err := f.CSIClientSet.CsiV1alpha1().CSINodeInfos().List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list CSINodeInfos: %v", err)
+	} else {
+		var relevant []csiv1alpha1.CSINodeInfo
+		for _, nodeInfo := range nodeInfos.Items {
+			for _, info := range nodeInfo.Spec.Drivers {
+				if info.Name == driverName {
+					relevant = append(relevant, nodeInfo)
+					break
+				}
+			}
+		}
+		b.addJSON("objects/csinodeinfos.json", relevant)
+	}
+
+	events, err := cs.CoreV1().Events(ns).List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list events in %s: %v", ns, err)
+	} else {
+		b.addJSON("objects/events.json", events.Items)
+	}
+	// Events for PVs end up in the default namespace.
+	events, err = cs.CoreV1().Events(metav1.NamespaceDefault).List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list events in %s: %v", metav1.NamespaceDefault, err)
+	} else {
+		var relevant []v1.Event
+		for _, event := range events.Items {
+			if event.InvolvedObject.Kind == "PersistentVolume" && volumeNames.Has(event.InvolvedObject.Name) {
+				relevant = append(relevant, event)
+			}
+		}
+		b.addJSON("objects/volume-events.json", relevant)
+	}
+}
+
+// collectDriverPods adds "kubectl describe" output and the last
+// -csi.diagnostics-tail log lines of all driver pods and the mount
+// table of each container in the plugin pod.
+func collectDriverPods(driver *manifestDriver, b *diagnosticsBundle) {
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+	ns := f.Namespace.Name
+	apps := sets.NewString()
+	for _, app := range []string{driver.driverPods.provisioner, driver.driverPods.attacher, driver.driverPods.plugin} {
+		if app != "" {
+			apps.Insert(app)
+		}
+	}
+
+	pods, err := cs.CoreV1().Pods(ns).List(metav1.ListOptions{})
+	if err != nil {
+		b.failed("list pods: %v", err)
+		return
+	}
+	tail := int64(csiTestContext.diagnosticsTail)
+	for _, pod := range pods.Items {
+		// Without known labels, all pods in the namespace are
+		// included.
+		if apps.Len() > 0 && !apps.Has(pod.Labels["app"]) {
+			continue
+		}
+		description, err := framework.RunKubectl("describe", "pod", pod.Name, "--namespace", ns)
+		if err != nil {
+			b.failed("describe pod %s: %v", pod.Name, err)
+		} else {
+			b.add(fmt.Sprintf("pods/%s.txt", pod.Name), []byte(description))
+		}
+
+		for _, status := range pod.Status.ContainerStatuses {
+			logs := func(previous bool, fileName string) {
+				data, err := cs.CoreV1().Pods(ns).GetLogs(pod.Name, &v1.PodLogOptions{
+					Container: status.Name,
+					TailLines: &tail,
+					Previous:  previous,
+				}).Do().Raw()
+				if err != nil {
+					b.failed("get logs of %s/%s: %v", pod.Name, status.Name, err)
+					return
+				}
+				b.add(fileName, data)
+			}
+			logs(false, fmt.Sprintf("logs/%s-%s.log", pod.Name, status.Name))
+			// The output before the last restart often
+			// explains the restart.
+			if status.RestartCount > 0 {
+				logs(true, fmt.Sprintf("logs/%s-%s.previous.log", pod.Name, status.Name))
+			}
+
+			if driver.driverPods.plugin != "" && pod.Labels["app"] == driver.driverPods.plugin && status.Ready {
+				mounts, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, status.Name, "cat", "/proc/self/mountinfo")
+				if err != nil {
+					b.failed("read mounts in %s/%s: %v: %s", pod.Name, status.Name, err, stderr)
+				} else {
+					b.add(fmt.Sprintf("mounts/%s-%s.txt", pod.Name, status.Name), []byte(mounts+"\n"))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// disruptionClaims is the number of claims that are pending while
+// the provisioner gets restarted.
+const disruptionClaims = 3
+
+type disruptionTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &disruptionTestSuite{}
+
+// initDisruptionTestSuite returns disruptionTestSuite that implements csiTestSuite interface
+func initDisruptionTestSuite() csiTestSuite {
+	return &disruptionTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name:       "disruption",
+			featureTag: "[Disruptive][Serial]",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *disruptionTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *disruptionTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *disruptionTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should provision pending claims after the provisioner restarts", func() {
+			app := driver.driverPods.provisioner
+			if app == "" {
+				framework.Skipf("Driver %s has no provisioner pod -- skipping", driver.driverInfo.Name)
+			}
+			cs := driver.driverInfo.Config.Framework.ClientSet
+
+			var pvcs []*v1.PersistentVolumeClaim
+			for i := 0; i < disruptionClaims; i++ {
+				pvcs = append(pvcs, resource.createClaim(""))
+			}
+			restartDriverPod(driver, app)
+
+			By("waiting for all claims to be bound")
+			_, err := framework.WaitForPVClaimBoundPhase(cs, pvcs, framework.ClaimProvisionTimeout)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should keep volumes usable while the node plugin restarts", func() {
+			app := driver.driverPods.plugin
+			if app == "" {
+				framework.Skipf("Driver %s has no node plugin pod -- skipping", driver.driverInfo.Name)
+			}
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			pvc, _ := resource.createBoundClaim("")
+			pod := createPodWithCSIVolume(cs, pvc.Namespace, nodeName, pvc, false)
+			defer func() {
+				framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+			}()
+			checkPodIO(f, pod, "before")
+
+			restartDriverPod(driver, app)
+			checkPodIO(f, pod, "after")
+
+			By("unmounting the volume with the restarted node plugin")
+			framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+			pod = nil
+
+			// Volumes of drivers which lose data on restart are
+			// gone together with the old plugin pod, only the
+			// existing mount still works.
+			if driver.restartLosesData {
+				By("using a new volume with the restarted node plugin")
+				pvc, _ = resource.createBoundClaim("")
+			} else {
+				By("mounting the volume again")
+			}
+			pod = createPodWithCSIVolume(cs, pvc.Namespace, nodeName, pvc, false)
+			checkPodIO(f, pod, "remount")
+		})
+
+		It("should attach volumes after the attacher restarts during attachment", func() {
+			app := driver.driverPods.attacher
+			if app == "" {
+				framework.Skipf("Driver %s has no attacher pod -- skipping", driver.driverInfo.Name)
+			}
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			pvc, _ := resource.createBoundClaim("")
+			pod := framework.MakePod(pvc.Namespace, nil, []*v1.PersistentVolumeClaim{pvc}, false, "")
+			pod.Spec.NodeName = nodeName
+			pod, err := cs.CoreV1().Pods(pod.Namespace).Create(pod)
+			Expect(err).NotTo(HaveOccurred())
+			defer func() {
+				framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+			}()
+			restartDriverPod(driver, app)
+
+			By("waiting for the pod to start")
+			err = framework.WaitForPodNameRunningInNamespace(cs, pod.Name, pod.Namespace)
+			Expect(err).NotTo(HaveOccurred())
+			pod, err = cs.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			checkPodIO(f, pod, "after attach")
+		})
+	})
+}
+
+// checkPodIO writes and reads a file in the volume that
+// createPodWithCSIVolume mounted in the pod.
+func checkPodIO(f *framework.Framework, pod *v1.Pod, stage string) {
+	By(fmt.Sprintf("checking I/O in pod %s (%s)", pod.Name, stage))
+	file := podVolumePath + "/" + stage
+	stdout, stderr, err := f.ExecShellInPodWithFullOutput(pod.Name, fmt.Sprintf("echo '%s' > '%s' && cat '%s'", stage, file, file))
+	Expect(err).NotTo(HaveOccurred(), "I/O in pod %s: %s", pod.Name, stderr)
+	Expect(stdout).To(Equal(stage))
+}
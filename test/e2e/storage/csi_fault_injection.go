@@ -0,0 +1,276 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	"github.com/kubernetes-csi/csi-e2e/pkg/csiproxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// proxyContainerName is the name of the container that
+	// patchCSIProxy adds to the driver pod.
+	proxyContainerName = "csi-proxy"
+
+	// The sockets of the driver and of the proxy control
+	// endpoint. They are created in the same directory as
+	// the original CSI socket.
+	proxyDriverSocket  = "csi-driver.sock"
+	proxyControlSocket = "csi-proxy.sock"
+)
+
+// patchCSIProxy inserts the fault injection proxy between the CSI
+// driver and all of its clients if -csi.proxy-image is set: the
+// driver container gets configured to listen on a different socket
+// and a proxy container takes over the original socket.
+func (m *manifestDriver) patchCSIProxy(item interface{}) error {
+	if !m.hasCSIProxy() {
+		return nil
+	}
+
+	spec := getPodSpec(item)
+	if spec == nil {
+		return nil
+	}
+
+	socketDir := path.Dir(m.csiSocket)
+	driverSocket := path.Join(socketDir, proxyDriverSocket)
+	controlSocket := path.Join(socketDir, proxyControlSocket)
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.Name != m.patchOptions.DriverContainerName {
+			continue
+		}
+
+		var socketMounts []v1.VolumeMount
+		for _, mount := range container.VolumeMounts {
+			if mount.MountPath == socketDir {
+				socketMounts = append(socketMounts, mount)
+			}
+		}
+		if len(socketMounts) == 0 {
+			return fmt.Errorf("container %s: no volume mounted at %s", container.Name, socketDir)
+		}
+		for e := range container.Args {
+			container.Args[e] = strings.Replace(container.Args[e], m.csiSocket, driverSocket, -1)
+		}
+		for e := range container.Env {
+			container.Env[e].Value = strings.Replace(container.Env[e].Value, m.csiSocket, driverSocket, -1)
+		}
+
+		spec.Containers = append(spec.Containers, v1.Container{
+			Name:            proxyContainerName,
+			Image:           csiTestContext.proxyImage,
+			ImagePullPolicy: v1.PullIfNotPresent,
+			Args: []string{
+				"--v=5",
+				"--endpoint=unix://" + m.csiSocket,
+				"--driver-endpoint=unix://" + driverSocket,
+				"--control-endpoint=unix://" + controlSocket,
+			},
+			VolumeMounts: socketMounts,
+		})
+		return nil
+	}
+	return nil
+}
+
+// hasCSIProxy is true if the proxy gets deployed for the driver.
+func (m *manifestDriver) hasCSIProxy() bool {
+	return csiTestContext.proxyImage != "" && m.csiSocket != "" && m.driverPods.plugin != ""
+}
+
+// runCSIProxy runs the csi-proxy binary in the proxy container of
+// the node plugin pod and returns its output.
+func runCSIProxy(driver *manifestDriver, args ...string) string {
+	stdout, err := execCSIProxy(driver, args...)
+	framework.ExpectNoError(err)
+	return stdout
+}
+
+// execCSIProxy is the same as runCSIProxy, except that it returns
+// an error instead of failing the test.
+func execCSIProxy(driver *manifestDriver, args ...string) (string, error) {
+	f := driver.driverInfo.Config.Framework
+	pod, err := findDriverPod(driver, driver.driverPods.plugin)
+	if err != nil {
+		return "", err
+	}
+	controlSocket := path.Join(path.Dir(driver.csiSocket), proxyControlSocket)
+	command := append([]string{"/csi-proxy", "--control-endpoint=unix://" + controlSocket}, args...)
+	stdout, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, proxyContainerName, command...)
+	if err != nil {
+		return "", fmt.Errorf("csi-proxy %v: %v: %s", args, err, stderr)
+	}
+	return stdout, nil
+}
+
+// setProxyFaults replaces the faults of the proxy.
+func setProxyFaults(driver *manifestDriver, faults ...csiproxy.Fault) {
+	data, err := json.Marshal(faults)
+	framework.ExpectNoError(err, "encode faults")
+	By(fmt.Sprintf("injecting faults %s", data))
+	runCSIProxy(driver, "set-faults", string(data))
+}
+
+// resetProxy removes all faults and clears the call statistics.
+func resetProxy(driver *manifestDriver) {
+	runCSIProxy(driver, "reset")
+}
+
+// getProxyCalls returns the call statistics for all gRPC methods
+// which match the method name, in the same way as for faults.
+func getProxyCalls(driver *manifestDriver, method string) csiproxy.CallStats {
+	var calls map[string]csiproxy.CallStats
+	output := runCSIProxy(driver, "get-calls")
+	err := json.Unmarshal([]byte(output), &calls)
+	framework.ExpectNoError(err, "decode call statistics %q", output)
+
+	var total csiproxy.CallStats
+	for fullMethod, stats := range calls {
+		if (csiproxy.Fault{Method: method}).Matches(fullMethod) {
+			total.Calls += stats.Calls
+			total.Faults += stats.Faults
+		}
+	}
+	framework.Logf("%s: %+v", method, total)
+	return total
+}
+
+type faultInjectionTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &faultInjectionTestSuite{}
+
+// initFaultInjectionTestSuite returns faultInjectionTestSuite that implements csiTestSuite interface
+func initFaultInjectionTestSuite() csiTestSuite {
+	return &faultInjectionTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "fault injection",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *faultInjectionTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *faultInjectionTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if csiTestContext.proxyImage == "" {
+		framework.Skipf("-csi.proxy-image not set -- skipping")
+	}
+	if !driver.hasCSIProxy() {
+		framework.Skipf("Driver %s does not support the fault injection proxy -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *faultInjectionTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+			resetProxy(driver)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				// Volumes must be deletable without faults.
+				resetProxy(driver)
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should retry CreateVolume after Unavailable", func() {
+			setProxyFaults(driver, csiproxy.Fault{Method: "CreateVolume", Code: codes.Unavailable, Count: 2})
+			resource.createBoundClaim("")
+
+			stats := getProxyCalls(driver, "CreateVolume")
+			Expect(stats.Faults).To(Equal(2), "failed CreateVolume calls")
+			Expect(stats.Calls).To(BeNumerically(">=", 3), "CreateVolume calls")
+			trace, err := getProxyTrace(driver)
+			framework.ExpectNoError(err)
+			Expect(trace).To(haveRetriesWithSameField("CreateVolume", "name"))
+			Expect(trace).To(haveNoFailedCallsExceptInjected())
+		})
+
+		It("should report CreateVolume timeouts as events", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+
+			setProxyFaults(driver, csiproxy.Fault{Method: "CreateVolume", Hang: true})
+			pvc := resource.createClaim("")
+			message := waitForClaimEvent(cs, pvc, "ProvisioningFailed", framework.ClaimProvisionTimeout)
+			Expect(message).To(MatchRegexp("(?i)deadline"), "ProvisioningFailed event should mention the timeout")
+
+			By("removing the fault")
+			resetProxy(driver)
+			resource.waitForBoundClaim(pvc)
+		})
+
+		It("should recover from dropped connections", func() {
+			setProxyFaults(driver, csiproxy.Fault{Method: "CreateVolume", Drop: true, Count: 1})
+			resource.createBoundClaim("")
+
+			stats := getProxyCalls(driver, "CreateVolume")
+			Expect(stats.Faults).To(Equal(1), "dropped CreateVolume calls")
+			Expect(stats.Calls).To(BeNumerically(">=", 2), "CreateVolume calls")
+		})
+
+		It("should undo all publish operations in the right order", func() {
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			cs := driver.driverInfo.Config.Framework.ClientSet
+
+			pvc, _ := resource.createBoundClaim("")
+			runInPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName, "echo hello > /mnt/test/data")
+
+			By("waiting for the volume to be unpublished")
+			Eventually(func() ([]csiproxy.Call, error) {
+				return getProxyTrace(driver)
+			}, framework.PodDeleteTimeout, framework.Poll).Should(haveMatchingUnpublishCalls())
+			trace, err := getProxyTrace(driver)
+			framework.ExpectNoError(err)
+			Expect(trace).To(haveCallBefore("NodeUnpublishVolume", "NodeUnstageVolume"))
+			Expect(trace).To(haveCallBefore("NodeUnpublishVolume", "ControllerUnpublishVolume"))
+			Expect(trace).To(haveNoFailedCallsExceptInjected())
+		})
+	})
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+// csiTestContextType contains the settings for the CSI test suites
+// in this package which cannot be part of the driver configuration
+// because they depend on the cluster that the tests run against.
+type csiTestContextType struct {
+	// How the kubelet restart tests stop and start kubelet:
+	// "ssh", "pod", "command" or empty (tests get skipped).
+	kubeletRestartMode string
+
+	// The shell command that is used for kubeletRestartMode
+	// "command".
+	kubeletCommand string
+
+	// The image of the fault injection proxy. If set, the proxy
+	// gets deployed in front of drivers which support it. The
+	// image is also used for the sanity helper pod.
+	proxyImage string
+
+	// If non-zero, the selected tests run repeatedly until this
+	// much time has passed.
+	soakDuration time.Duration
+
+	// The image with fio for the benchmark suite, which gets
+	// skipped when empty.
+	fioImage string
+
+	// Comma-separated fio profiles for the benchmark suite.
+	benchmarkProfiles string
+
+	// The size of the file which fio uses.
+	benchmarkSize string
+
+	// How long each fio profile runs.
+	benchmarkRuntime time.Duration
+
+	// Whether fio bypasses the page cache.
+	benchmarkDirectIO bool
+
+	// A JSON file with results of an earlier benchmark run.
+	benchmarkBaseline string
+
+	// How many percent worse than the baseline a result may be.
+	benchmarkThreshold float64
+
+	// Either "always" or "on-failure".
+	podLogs string
+
+	// The -csi.pod-logs=on-failure limits and filters.
+	podLogsMaxBytes   int64
+	podLogsTail       int
+	podLogsContainers string
+	podLogsLevel      string
+
+	// The number of log lines per container in the diagnostics
+	// of failed tests.
+	diagnosticsTail int
+
+	// What to do about leaked objects: "off", "warn" or "fail".
+	leakCheck string
+
+	// Two conformance matrices which get compared instead of
+	// running tests.
+	matrixCompare string
+
+	// Whether to write a timeline for each test.
+	timeline     bool
+	timelineHTML bool
+}
+
+// csiTestContext is filled in from the command line flags,
+// which get parsed by framework.HandleFlags.
+var csiTestContext csiTestContextType
+
+func init() {
+	flag.StringVar(&csiTestContext.kubeletRestartMode, "csi.kubelet-restart", "",
+		"Enables the kubelet restart tests and selects how kubelet gets stopped and started: "+
+			"'ssh' (same as in Kubernetes, needs SSH access to the nodes), "+
+			"'pod' (systemctl via a privileged pod on the node) or "+
+			"'command' (see -csi.kubelet-command).")
+	flag.StringVar(&csiTestContext.kubeletCommand, "csi.kubelet-command", "",
+		"A shell command that is used to stop, start or restart kubelet when -csi.kubelet-restart=command. "+
+			"It gets invoked with KUBELET_OPERATION=stop/start/restart and NODE_NAME=<node name> in its environment.")
+	flag.StringVar(&csiTestContext.proxyImage, "csi.proxy-image", "",
+		"The csi-proxy image (see cmd/csi-proxy). If set, the proxy gets deployed between the sidecars and the CSI driver "+
+			"and the fault injection and sanity tests are enabled.")
+	flag.DurationVar(&csiTestContext.soakDuration, "csi.soak-duration", 0,
+		"Runs the selected tests repeatedly until this much time has passed, checks for leaked volumes and mounts "+
+			"between iterations and samples the resource usage of the driver pods. The soak report gets written to "+
+			"the -report-dir. Not supported for parallel runs.")
+	flag.StringVar(&csiTestContext.fioImage, "csi.fio-image", "",
+		"An image with fio (>= 3.0) and sh. If set, the benchmark suite runs the -csi.benchmark-profiles against a volume of each driver "+
+			"and writes the results as JSON and CSV into the csi-benchmark sub-directory of the -report-dir.")
+	flag.StringVar(&csiTestContext.benchmarkProfiles, "csi.benchmark-profiles", strings.Join(fioProfileNames(), ","),
+		"Comma-separated list of fio profiles for the benchmark suite. Besides the predefined profiles, "+
+			"custom ones can be given as <name>:<fio arguments separated by spaces>, for example 'rand-read-64k:--rw=randread --bs=64k --iodepth=8'.")
+	flag.StringVar(&csiTestContext.benchmarkSize, "csi.benchmark-size", "256Mi",
+		"The size of the file used by fio. The claim is twice as large.")
+	flag.DurationVar(&csiTestContext.benchmarkRuntime, "csi.benchmark-runtime", 30*time.Second,
+		"How long each fio profile runs.")
+	flag.BoolVar(&csiTestContext.benchmarkDirectIO, "csi.benchmark-direct", true,
+		"Run fio with O_DIRECT. Must be disabled for drivers whose filesystem does not support it.")
+	flag.StringVar(&csiTestContext.benchmarkBaseline, "csi.benchmark-baseline", "",
+		"A JSON file written by an earlier benchmark run. Results which are worse than the baseline by more than "+
+			"-csi.benchmark-threshold fail the benchmark.")
+	flag.Float64Var(&csiTestContext.benchmarkThreshold, "csi.benchmark-threshold", 10,
+		"How many percent lower IOPS and bandwidth or higher latency than in the -csi.benchmark-baseline are tolerated.")
+	flag.StringVar(&csiTestContext.podLogs, "csi.pod-logs", podLogsAlways,
+		"When to write the output of pods and their events: \"always\" or \"on-failure\". With \"on-failure\", "+
+			"the output is kept in memory while a test runs and only gets written when the test fails.")
+	flag.Int64Var(&csiTestContext.podLogsMaxBytes, "csi.pod-logs-max-bytes", 10*1024*1024,
+		"With -csi.pod-logs=on-failure, the maximum amount of output kept per container. Older lines get dropped.")
+	flag.IntVar(&csiTestContext.podLogsTail, "csi.pod-logs-tail", 1000,
+		"With -csi.pod-logs=on-failure, the number of most recent lines written per container, 0 for all kept lines.")
+	flag.StringVar(&csiTestContext.podLogsContainers, "csi.pod-logs-containers", "",
+		"With -csi.pod-logs=on-failure, a comma-separated list of container names whose output is kept. Empty keeps all containers.")
+	flag.StringVar(&csiTestContext.podLogsLevel, "csi.pod-logs-level", "",
+		"With -csi.pod-logs=on-failure, the minimum severity (info, warning, error) of glog lines which are kept. "+
+			"Lines which are not in glog format are always kept.")
+	flag.IntVar(&csiTestContext.diagnosticsTail, "csi.diagnostics-tail", 500,
+		"The number of most recent log lines per driver container which get added to the diagnostics of a failed test.")
+	flag.StringVar(&csiTestContext.leakCheck, "csi.leak-check", leakCheckWarn,
+		"Whether objects and node directories left behind by a test only cause a warning (\"warn\"), fail the test (\"fail\") "+
+			"or are not checked at all (\"off\").")
+	flag.StringVar(&csiTestContext.matrixCompare, "csi.matrix-compare", "",
+		"<old>,<new>: compares two csi-matrix.json files written by earlier test runs instead of running tests and "+
+			"fails if a suite and pattern which passed for a driver in the old matrix no longer passes in the new one.")
+	flag.BoolVar(&csiTestContext.timeline, "csi.timeline", true,
+		"With -report-dir, write the steps, framework log output, pod events and pod logs of each test sorted by time into timeline.log "+
+			"in the directory of the test.")
+	flag.BoolVar(&csiTestContext.timelineHTML, "csi.timeline-html", false,
+		"Also write the timeline as timeline.html, which can be filtered by source.")
+}
@@ -0,0 +1,343 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+	"k8s.io/kubernetes/test/e2e/storage/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// kubeletDownTime is how long kubelet stays stopped when it
+	// gets stopped through a pod. Such a pod cannot start kubelet
+	// again because "kubectl exec" depends on kubelet, therefore
+	// systemd gets told to start it again after this time.
+	kubeletDownTime = 3 * time.Minute
+
+	// kubeletStartUnit is the name of the transient systemd unit
+	// which starts kubelet after kubeletDownTime.
+	kubeletStartUnit = "csi-e2e-kubelet-start"
+
+	// kubeletRestartMountPath is where the pods of the kubelet
+	// restart tests have the volume. The tests from the utils
+	// package expect it there.
+	kubeletRestartMountPath = "/mnt"
+)
+
+type kubeletRestartTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &kubeletRestartTestSuite{}
+
+// initKubeletRestartTestSuite returns kubeletRestartTestSuite that implements csiTestSuite interface
+func initKubeletRestartTestSuite() csiTestSuite {
+	return &kubeletRestartTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name:       "kubelet restart",
+			featureTag: "[Disruptive][Serial]",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *kubeletRestartTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *kubeletRestartTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if csiTestContext.kubeletRestartMode == "" {
+		framework.Skipf("Kubelet restart tests need -csi.kubelet-restart -- skipping")
+	}
+	if csiTestContext.kubeletRestartMode == "ssh" {
+		framework.SkipUnlessSSHKeyPresent()
+	}
+}
+
+func (t *kubeletRestartTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			kubelet      kubeletController
+			pod          *v1.Pod
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			f := driver.driverInfo.Config.Framework
+			kubelet = newKubeletController(f, csiTestContext.kubeletRestartMode)
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+			pvc, _ := resource.createBoundClaim("")
+			pod = createKubeletRestartPod(f, pvc, driver.driverInfo.Config.ClientNodeName)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				f := driver.driverInfo.Config.Framework
+				framework.ExpectNoError(framework.DeletePodWithWait(f, f.ClientSet, pod))
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		// With SSH, the tests from the utils package are used
+		// as they are.
+		It("should keep a mounted volume readable after kubelet restarts", func() {
+			f := driver.driverInfo.Config.Framework
+			if kubelet == nil {
+				utils.TestKubeletRestartsAndRestoresMount(f.ClientSet, f, pod)
+				return
+			}
+			testKubeletRestartsAndRestoresMount(f, kubelet, pod)
+		})
+
+		It("should unmount the volume of a pod deleted while kubelet is down", func() {
+			f := driver.driverInfo.Config.Framework
+			if kubelet == nil {
+				utils.TestVolumeUnmountsFromDeletedPodWithForceOption(f.ClientSet, f, pod, false, false)
+				return
+			}
+			testVolumeUnmountsFromDeletedPod(f, kubelet, pod, false)
+		})
+
+		It("should unmount the volume of a pod force-deleted while kubelet is down", func() {
+			f := driver.driverInfo.Config.Framework
+			if kubelet == nil {
+				utils.TestVolumeUnmountsFromDeletedPodWithForceOption(f.ClientSet, f, pod, true, false)
+				return
+			}
+			testVolumeUnmountsFromDeletedPod(f, kubelet, pod, true)
+		})
+	})
+}
+
+// createKubeletRestartPod starts a pod which has the volume mounted at
+// kubeletRestartMountPath.
+func createKubeletRestartPod(f *framework.Framework, pvc *v1.PersistentVolumeClaim, nodeName string) *v1.Pod {
+	pod := framework.MakePod(pvc.Namespace, nil, []*v1.PersistentVolumeClaim{pvc}, false, "")
+	pod.Spec.NodeName = nodeName
+	pod.Spec.Containers[0].VolumeMounts[0].MountPath = kubeletRestartMountPath
+	return createRunningPod(f.ClientSet, pod)
+}
+
+// kubeletController stops, starts or restarts kubelet on the node of
+// a pod and then waits for the node to change its state accordingly.
+// It also provides shell access to the node. SSH needs no
+// kubeletController because the tests from the utils package are
+// used for it.
+type kubeletController interface {
+	// kubelet has the same semantic as utils.KubeletCommand.
+	kubelet(op utils.KubeletOpt, pod *v1.Pod)
+	// exec runs a shell command on the node of the pod and
+	// returns its stdout.
+	exec(pod *v1.Pod, command string) (string, error)
+}
+
+func newKubeletController(f *framework.Framework, mode string) kubeletController {
+	switch mode {
+	case "ssh":
+		return nil
+	case "pod":
+		return podKubelet{f}
+	case "command":
+		if csiTestContext.kubeletCommand == "" {
+			framework.Failf("-csi.kubelet-restart=command needs -csi.kubelet-command")
+		}
+		return commandKubelet{f, csiTestContext.kubeletCommand}
+	default:
+		framework.Failf("unsupported -csi.kubelet-restart=%s", mode)
+		return nil
+	}
+}
+
+// podKubelet uses systemctl inside a privileged pod on the node.
+// The actual commands are scheduled with systemd-run, so they
+// still get executed when kubelet goes down in the middle of
+// "kubectl exec".
+type podKubelet struct {
+	f *framework.Framework
+}
+
+func (p podKubelet) kubelet(op utils.KubeletOpt, pod *v1.Pod) {
+	nodeName := pod.Spec.NodeName
+	switch op {
+	case utils.KStop:
+		// Ensure that kubelet comes back even when the test
+		// fails. A start that is still pending from an earlier
+		// stop gets replaced.
+		_, err := p.exec(pod, fmt.Sprintf("systemctl stop %[1]s.timer; systemctl reset-failed %[1]s.service; systemd-run --unit=%[1]s --on-active=%[2]d systemctl start kubelet",
+			kubeletStartUnit, int(kubeletDownTime.Seconds())))
+		Expect(err).NotTo(HaveOccurred(), "schedule kubelet start on node %s", nodeName)
+		_, err = p.exec(pod, "systemd-run --on-active=1 systemctl stop kubelet")
+		Expect(err).NotTo(HaveOccurred(), "schedule kubelet stop on node %s", nodeName)
+		if ok := framework.WaitForNodeToBeNotReady(p.f.ClientSet, nodeName, utils.NodeStateTimeout); !ok {
+			framework.Failf("Node %s failed to enter NotReady state", nodeName)
+		}
+	case utils.KStart:
+		// Kubelet gets started by the timer from KStop.
+		if ok := framework.WaitForNodeToBeReady(p.f.ClientSet, nodeName, kubeletDownTime+utils.NodeStateTimeout); !ok {
+			framework.Failf("Node %s failed to enter Ready state", nodeName)
+		}
+		// When kubelet came back some other way, the timer is
+		// still pending and must not start kubelet while a
+		// later test has it stopped.
+		_, err := p.exec(pod, fmt.Sprintf("systemctl stop %s.timer || true", kubeletStartUnit))
+		Expect(err).NotTo(HaveOccurred(), "cancel kubelet start on node %s", nodeName)
+	case utils.KRestart:
+		pid, err := p.exec(pod, "systemctl show --property=MainPID kubelet")
+		Expect(err).NotTo(HaveOccurred(), "get kubelet PID on node %s", nodeName)
+		_, err = p.exec(pod, "systemd-run --on-active=1 systemctl restart kubelet")
+		Expect(err).NotTo(HaveOccurred(), "schedule kubelet restart on node %s", nodeName)
+		err = wait.Poll(2*time.Second, time.Minute, func() (bool, error) {
+			// Errors are expected while kubelet is down.
+			newPid, err := p.exec(pod, "systemctl show --property=MainPID kubelet")
+			return err == nil && newPid != pid, nil
+		})
+		Expect(err).NotTo(HaveOccurred(), "Kubelet PID remained unchanged after restarting Kubelet")
+		if ok := framework.WaitForNodeToBeReady(p.f.ClientSet, nodeName, utils.NodeStateTimeout); !ok {
+			framework.Failf("Node %s failed to enter Ready state", nodeName)
+		}
+	}
+}
+
+func (p podKubelet) exec(pod *v1.Pod, command string) (string, error) {
+	stdout, stderr, err := execOnNode(p.f, pod.Spec.NodeName, command)
+	if err != nil {
+		return stdout, fmt.Errorf("%q: %v: %s", command, err, stderr)
+	}
+	return stdout, nil
+}
+
+// commandKubelet invokes a user-supplied command for kubelet
+// operations and a privileged pod for running commands on the node.
+type commandKubelet struct {
+	f       *framework.Framework
+	command string
+}
+
+func (c commandKubelet) kubelet(op utils.KubeletOpt, pod *v1.Pod) {
+	nodeName := pod.Spec.NodeName
+	cmd := exec.Command("/bin/sh", "-c", c.command)
+	cmd.Env = append(os.Environ(),
+		"KUBELET_OPERATION="+string(op),
+		"NODE_NAME="+nodeName,
+	)
+	framework.Logf("Attempting `%s` with KUBELET_OPERATION=%s NODE_NAME=%s", c.command, op, nodeName)
+	out, err := cmd.CombinedOutput()
+	framework.Logf("Output:\n%s", out)
+	Expect(err).NotTo(HaveOccurred(), "Failed to [%s] kubelet on node %s", op, nodeName)
+
+	switch op {
+	case utils.KStop:
+		if ok := framework.WaitForNodeToBeNotReady(c.f.ClientSet, nodeName, utils.NodeStateTimeout); !ok {
+			framework.Failf("Node %s failed to enter NotReady state", nodeName)
+		}
+	case utils.KStart, utils.KRestart:
+		if ok := framework.WaitForNodeToBeReady(c.f.ClientSet, nodeName, utils.NodeStateTimeout); !ok {
+			framework.Failf("Node %s failed to enter Ready state", nodeName)
+		}
+	}
+}
+
+func (c commandKubelet) exec(pod *v1.Pod, command string) (string, error) {
+	return podKubelet{c.f}.exec(pod, command)
+}
+
+// testKubeletRestartsAndRestoresMount is the counterpart of
+// utils.TestKubeletRestartsAndRestoresMount with a configurable
+// kubeletController.
+func testKubeletRestartsAndRestoresMount(f *framework.Framework, kubelet kubeletController, clientPod *v1.Pod) {
+	By("Writing to the volume.")
+	file := kubeletRestartMountPath + "/_SUCCESS"
+	_, stderr, err := f.ExecShellInPodWithFullOutput(clientPod.Name, fmt.Sprintf("touch %s", file))
+	Expect(err).NotTo(HaveOccurred(), stderr)
+
+	By("Restarting kubelet")
+	kubelet.kubelet(utils.KRestart, clientPod)
+
+	By("Testing that written file is accessible.")
+	_, stderr, err = f.ExecShellInPodWithFullOutput(clientPod.Name, fmt.Sprintf("cat %s", file))
+	Expect(err).NotTo(HaveOccurred(), stderr)
+	framework.Logf("Volume mount detected on pod %s and written file %s is readable post-restart.", clientPod.Name, file)
+}
+
+// testVolumeUnmountsFromDeletedPod is the counterpart of
+// utils.TestVolumeUnmountsFromDeletedPodWithForceOption with a
+// configurable kubeletController.
+func testVolumeUnmountsFromDeletedPod(f *framework.Framework, kubelet kubeletController, clientPod *v1.Pod, forceDelete bool) {
+	c := f.ClientSet
+	mountCheck := fmt.Sprintf("mount | grep %s | grep -v volume-subpaths || true", clientPod.UID)
+
+	By("Expecting the volume mount to be found.")
+	out, err := kubelet.exec(clientPod, mountCheck)
+	Expect(err).NotTo(HaveOccurred(), "Encountered error while checking mounts.")
+	Expect(strings.TrimSpace(out)).NotTo(BeEmpty(), "Expected volume mount of pod %s.", clientPod.Name)
+
+	// This command is to make sure kubelet is started after test finishes no matter it fails or not.
+	defer func() {
+		kubelet.kubelet(utils.KStart, clientPod)
+	}()
+	By("Stopping the kubelet.")
+	kubelet.kubelet(utils.KStop, clientPod)
+
+	By(fmt.Sprintf("Deleting Pod %q", clientPod.Name))
+	if forceDelete {
+		err = c.CoreV1().Pods(clientPod.Namespace).Delete(clientPod.Name, metav1.NewDeleteOptions(0))
+	} else {
+		err = c.CoreV1().Pods(clientPod.Namespace).Delete(clientPod.Name, &metav1.DeleteOptions{})
+	}
+	Expect(err).NotTo(HaveOccurred())
+
+	By("Starting the kubelet and waiting for pod to delete.")
+	kubelet.kubelet(utils.KStart, clientPod)
+	err = f.WaitForPodNotFound(clientPod.Name, framework.PodDeleteTimeout)
+	Expect(err).NotTo(HaveOccurred(), "Expected pod to be not found.")
+
+	By("Expecting the volume mount not to be found.")
+	// With forceDelete, since pods are immediately deleted from API server, there is no way to be sure when volumes are torn down,
+	// so poll instead of checking once.
+	err = wait.PollImmediate(framework.Poll, time.Minute, func() (bool, error) {
+		out, err := kubelet.exec(clientPod, mountCheck)
+		if err != nil {
+			framework.Logf("checking mounts: %v", err)
+			return false, nil
+		}
+		return strings.TrimSpace(out) == "", nil
+	})
+	Expect(err).NotTo(HaveOccurred(), "Expected no mount for pod %s.", clientPod.Name)
+	framework.Logf("Volume unmounted on node %s", clientPod.Spec.NodeName)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	csi "k8s.io/csi-api/pkg/client/clientset/versioned"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// The values of -csi.leak-check.
+const (
+	leakCheckOff  = "off"
+	leakCheckWarn = "warn"
+	leakCheckFail = "fail"
+)
+
+// leakChecker finds objects and node directories which were left
+// behind by tests. Everything that was created while a test ran and
+// still references the test namespace or the unique name derived from
+// it (for example in the driver name, in the name of uniquified
+// ClusterRoles or in the claim of a PV) counts as leaked. On the
+// nodes, directories named after the PVs of the tests count as well.
+type leakChecker struct {
+	cs    clientset.Interface
+	csiCS csi.Interface
+
+	// The cluster objects before the first test and the unique
+	// names of all tests, for the check at the end of the suite.
+	suiteObjects map[string]string
+	uniqueNames  []string
+
+	// The names of all PVs that were bound to claims of the
+	// tests. They are recorded while the tests run because the
+	// PVs normally are gone afterwards.
+	mutex       sync.Mutex
+	volumeNames sets.String
+
+	// The cluster objects before the current test and its
+	// unique name.
+	testObjects map[string]string
+	uniqueName  string
+	stopWatch   chan struct{}
+}
+
+var leaks leakChecker
+
+// beforeTest takes the snapshot for the test. It must be called
+// after the framework created the test namespace.
+func (l *leakChecker) beforeTest(f *framework.Framework) {
+	switch csiTestContext.leakCheck {
+	case leakCheckOff:
+		return
+	case leakCheckWarn, leakCheckFail:
+	default:
+		framework.Failf("unknown -csi.leak-check %q, must be one of %s, %s, %s",
+			csiTestContext.leakCheck, leakCheckOff, leakCheckWarn, leakCheckFail)
+	}
+
+	l.cs = f.ClientSet
+	l.csiCS = f.CSIClientSet
+	objects, err := listClusterObjects(l.cs, l.csiCS)
+	framework.ExpectNoError(err, "list cluster objects for leak check")
+	if l.suiteObjects == nil {
+		l.suiteObjects = objects
+	}
+	l.testObjects = objects
+	l.uniqueName = f.UniqueName
+	l.uniqueNames = append(l.uniqueNames, f.UniqueName)
+	l.watchVolumes(f.Namespace.Name)
+}
+
+// watchVolumes records the PVs which get bound to claims in the
+// namespace until afterTest.
+func (l *leakChecker) watchVolumes(namespace string) {
+	record := func(obj interface{}) {
+		pv, ok := obj.(*v1.PersistentVolume)
+		if !ok || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
+			return
+		}
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.volumeNames == nil {
+			l.volumeNames = sets.NewString()
+		}
+		l.volumeNames.Insert(pv.Name)
+	}
+	_, controller := cache.NewInformer(
+		cache.NewListWatchFromClient(l.cs.CoreV1().RESTClient(), "persistentvolumes", metav1.NamespaceAll, fields.Everything()),
+		&v1.PersistentVolume{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: record,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				record(newObj)
+			},
+		},
+	)
+	l.stopWatch = make(chan struct{})
+	go controller.Run(l.stopWatch)
+}
+
+// afterTest reports the objects leaked by the test. It must be called
+// after the framework deleted the test namespace.
+func (l *leakChecker) afterTest() {
+	if l.stopWatch != nil {
+		close(l.stopWatch)
+		l.stopWatch = nil
+	}
+	if l.testObjects == nil {
+		return
+	}
+	objects, err := listClusterObjects(l.cs, l.csiCS)
+	testObjects, uniqueName := l.testObjects, l.uniqueName
+	l.testObjects = nil
+	framework.ExpectNoError(err, "list cluster objects for leak check")
+	reportLeaks("after the test", findLeakedObjects(testObjects, objects, []string{uniqueName}))
+}
+
+// CheckLeaksAfterSuite reports objects and directories on the nodes
+// which were left behind by any of the tests that ran in this
+// process. It is meant to be called in the AfterSuite, after the
+// cleanup actions.
+//
+// On the nodes, the top levels of the kubelet directory are searched
+// for the unique names of the tests (for example the plugin
+// directory of a renamed driver) and the CSI volume directories of
+// pods, staging and block volumes for the names of the PVs of the
+// tests. Data which a driver keeps inside its own containers, like
+// the hostpath driver under /tmp, is removed together with the
+// driver and therefore not checked.
+func CheckLeaksAfterSuite() {
+	l := &leaks
+	if l.suiteObjects == nil {
+		return
+	}
+	objects, err := listClusterObjects(l.cs, l.csiCS)
+	framework.ExpectNoError(err, "list cluster objects for leak check")
+	found := findLeakedObjects(l.suiteObjects, objects, l.uniqueNames)
+
+	// Checking the nodes needs a pod on each of them, which is
+	// too slow to do after each test.
+	var grep []string
+	for _, name := range l.uniqueNames {
+		grep = append(grep, "-e", name)
+	}
+	l.mutex.Lock()
+	for _, name := range l.volumeNames.List() {
+		grep = append(grep, "-e", name)
+	}
+	l.mutex.Unlock()
+	if len(grep) > 0 {
+		err = forEachNode(l.cs, "csi-leaks", func(f *framework.Framework, nodeName string) error {
+			// grep exits with 1 when nothing was found, which is
+			// not an error.
+			stdout, stderr, err := execOnNode(f, nodeName,
+				fmt.Sprintf("{ find /var/lib/kubelet -maxdepth 3; ls -d %s 2>/dev/null; } | grep -F %s || test $? -eq 1",
+					strings.Join(csiVolumeDirs, " "), strings.Join(grep, " ")))
+			if err != nil {
+				return fmt.Errorf("%v: %s", err, stderr)
+			}
+			for _, path := range strings.Fields(stdout) {
+				found = append(found, fmt.Sprintf("node %s: %s", nodeName, path))
+			}
+			return nil
+		})
+		if err != nil {
+			found = append(found, fmt.Sprintf("checking nodes failed: %v", err))
+		}
+	}
+	reportLeaks("after the suite", found)
+}
+
+// csiVolumeDirs are the directories which kubelet creates for each
+// CSI volume, named after the PV.
+var csiVolumeDirs = []string{
+	"/var/lib/kubelet/pods/*/volumes/kubernetes.io~csi/*",
+	"/var/lib/kubelet/pods/*/volumeDevices/kubernetes.io~csi/*",
+	"/var/lib/kubelet/plugins/kubernetes.io/csi/pv/*",
+	"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/*",
+}
+
+func reportLeaks(when string, found []string) {
+	if len(found) == 0 {
+		return
+	}
+	message := fmt.Sprintf("%d leaked objects %s:\n  %s", len(found), when, strings.Join(found, "\n  "))
+	if csiTestContext.leakCheck == leakCheckFail {
+		framework.Failf("%s", message)
+	}
+	framework.Logf("WARNING: %s", message)
+}
+
+// findLeakedObjects returns the objects which are not in the snapshot
+// and reference one of the names.
+func findLeakedObjects(before, after map[string]string, names []string) []string {
+	var found []string
+	for key, description := range after {
+		if _, ok := before[key]; ok {
+			continue
+		}
+		for _, name := range names {
+			if strings.Contains(key, name) || strings.Contains(description, name) {
+				found = append(found, key+" ("+description+")")
+				break
+			}
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// listClusterObjects returns the cluster-scoped storage and RBAC
+// objects as "<kind> <name>", together with a description which
+// contains everything through which the object may reference a test.
+// The CSIDriver and CSINodeInfo CRDs are optional, objects of those
+// kinds are only listed when they are installed.
+func listClusterObjects(cs clientset.Interface, csiCS csi.Interface) (map[string]string, error) {
+	objects := map[string]string{}
+
+	pvs, err := cs.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range pvs.Items {
+		description := "phase " + string(pv.Status.Phase)
+		if pv.Spec.ClaimRef != nil {
+			description += fmt.Sprintf(", claim %s/%s", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+		}
+		if pv.Spec.CSI != nil {
+			description += ", driver " + pv.Spec.CSI.Driver
+		}
+		objects["PersistentVolume "+pv.Name] = description
+	}
+
+	vas, err := cs.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, va := range vas.Items {
+		pv := ""
+		if va.Spec.Source.PersistentVolumeName != nil {
+			pv = *va.Spec.Source.PersistentVolumeName
+		}
+		objects["VolumeAttachment "+va.Name] = fmt.Sprintf("attacher %s, node %s, PV %s", va.Spec.Attacher, va.Spec.NodeName, pv)
+	}
+
+	scs, err := cs.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, sc := range scs.Items {
+		objects["StorageClass "+sc.Name] = "provisioner " + sc.Provisioner
+	}
+
+	roles, err := cs.RbacV1().ClusterRoles().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles.Items {
+		objects["ClusterRole "+role.Name] = fmt.Sprintf("%d rules", len(role.Rules))
+	}
+
+	bindings, err := cs.RbacV1().ClusterRoleBindings().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, binding := range bindings.Items {
+		var subjects []string
+		for _, subject := range binding.Subjects {
+			subjects = append(subjects, fmt.Sprintf("%s %s/%s", subject.Kind, subject.Namespace, subject.Name))
+		}
+		objects["ClusterRoleBinding "+binding.Name] = fmt.Sprintf("role %s, subjects %s", binding.RoleRef.Name, strings.Join(subjects, ", "))
+	}
+
+	if drivers, err := csiCS.CsiV1alpha1().CSIDrivers().List(metav1.ListOptions{}); err == nil {
+		for _, driver := range drivers.Items {
+			objects["CSIDriver "+driver.Name] = "driver " + driver.Name
+		}
+	}
+	// Nodes stay, so each driver entry is treated like an object
+	// of its own.
+	if nodeInfos, err := csiCS.CsiV1alpha1().CSINodeInfos().List(metav1.ListOptions{}); err == nil {
+		for _, nodeInfo := range nodeInfos.Items {
+			for _, driver := range nodeInfo.Spec.Drivers {
+				objects[fmt.Sprintf("CSINodeInfo %s driver %s", nodeInfo.Name, driver.Name)] = "node ID " + driver.NodeID
+			}
+		}
+	}
+
+	return objects, nil
+}
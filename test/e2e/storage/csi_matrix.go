@@ -0,0 +1,432 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	"github.com/onsi/ginkgo/types"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// The status of a cell in the conformance matrix.
+const (
+	matrixPassed  = "passed"
+	matrixFailed  = "failed"
+	matrixSkipped = "skipped"
+	// Only used when comparing, for combinations that are
+	// missing in one of the matrices.
+	matrixNotRun = "not run"
+)
+
+// testPatternText matches the text of the Context created for a test
+// suite and pattern by getCSITestNameStr and by the testsuites
+// package, for example "[Testpattern: Dynamic PV (default fs)] volumes".
+var testPatternText = regexp.MustCompile(`^\[Testpattern: ([^\]]*)\]\S* (.*)$`)
+
+// conformanceMatrix shows for each test suite and pattern whether the
+// tests passed for each driver.
+type conformanceMatrix struct {
+	// The driver names as returned by
+	// testsuites.GetDriverNameWithFeatureTags.
+	Drivers []string     `json:"drivers"`
+	Rows    []*matrixRow `json:"rows"`
+}
+
+type matrixRow struct {
+	Suite   string `json:"suite"`
+	Pattern string `json:"pattern"`
+	// Indexed by driver name.
+	Cells map[string]*matrixCell `json:"cells"`
+}
+
+type matrixCell struct {
+	Status  string `json:"status"`
+	Passed  int    `json:"passed"`
+	Failed  int    `json:"failed"`
+	Skipped int    `json:"skipped"`
+	// Why tests failed or were skipped, as "<test>: <message>".
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// add updates the cell of the driver, suite and pattern with the
+// result of one test.
+func (m *conformanceMatrix) add(driver, suite, pattern, test string, state types.SpecState, message string) {
+	var row *matrixRow
+	for _, r := range m.Rows {
+		if r.Suite == suite && r.Pattern == pattern {
+			row = r
+			break
+		}
+	}
+	if row == nil {
+		row = &matrixRow{Suite: suite, Pattern: pattern, Cells: map[string]*matrixCell{}}
+		m.Rows = append(m.Rows, row)
+	}
+	cell := row.Cells[driver]
+	if cell == nil {
+		cell = &matrixCell{}
+		row.Cells[driver] = cell
+		m.Drivers = append(m.Drivers, driver)
+	}
+
+	// Only the first line, the rest is usually a stack trace
+	// or a long object dump.
+	message = strings.SplitN(strings.TrimSpace(message), "\n", 2)[0]
+	switch state {
+	case types.SpecStatePassed:
+		cell.Passed++
+	case types.SpecStateSkipped:
+		cell.Skipped++
+		cell.addReason(test + ": " + message)
+	default:
+		cell.Failed++
+		cell.addReason(fmt.Sprintf("%s: %s: %s", test, failureStateName(state), message))
+	}
+	switch {
+	case cell.Failed > 0:
+		cell.Status = matrixFailed
+	case cell.Passed > 0:
+		cell.Status = matrixPassed
+	default:
+		cell.Status = matrixSkipped
+	}
+}
+
+// addReason records why a test did not pass. The same test fails or
+// gets skipped for the same reason in each soak iteration, which gets
+// listed only once.
+func (c *matrixCell) addReason(reason string) {
+	for _, r := range c.Reasons {
+		if r == reason {
+			return
+		}
+	}
+	c.Reasons = append(c.Reasons, reason)
+}
+
+// failureStateName describes how a test did not pass.
+func failureStateName(state types.SpecState) string {
+	switch state {
+	case types.SpecStateFailed:
+		return "failed"
+	case types.SpecStatePanicked:
+		return "panicked"
+	case types.SpecStateTimedOut:
+		return "timed out"
+	default:
+		return fmt.Sprintf("state %d", state)
+	}
+}
+
+// sort brings drivers and rows into a stable order and removes
+// duplicate driver names.
+func (m *conformanceMatrix) sort() {
+	drivers := map[string]bool{}
+	for _, driver := range m.Drivers {
+		drivers[driver] = true
+	}
+	m.Drivers = nil
+	for driver := range drivers {
+		m.Drivers = append(m.Drivers, driver)
+	}
+	sort.Strings(m.Drivers)
+	sort.Slice(m.Rows, func(i, j int) bool {
+		if m.Rows[i].Suite != m.Rows[j].Suite {
+			return m.Rows[i].Suite < m.Rows[j].Suite
+		}
+		return m.Rows[i].Pattern < m.Rows[j].Pattern
+	})
+}
+
+// status returns the status of a cell, matrixNotRun if the cell does
+// not exist.
+func (m *conformanceMatrix) status(suite, pattern, driver string) string {
+	for _, row := range m.Rows {
+		if row.Suite == suite && row.Pattern == pattern {
+			if cell := row.Cells[driver]; cell != nil {
+				return cell.Status
+			}
+		}
+	}
+	return matrixNotRun
+}
+
+func (m *conformanceMatrix) writeMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "# CSI Conformance Matrix\n\n")
+	fmt.Fprintf(w, "| Suite | Pattern | %s |\n", strings.Join(m.Drivers, " | "))
+	fmt.Fprintf(w, "|---|---|%s\n", strings.Repeat("---|", len(m.Drivers)))
+	for _, row := range m.Rows {
+		fmt.Fprintf(w, "| %s | %s |", row.Suite, row.Pattern)
+		for _, driver := range m.Drivers {
+			cell := row.Cells[driver]
+			if cell == nil {
+				fmt.Fprintf(w, " %s |", matrixNotRun)
+				continue
+			}
+			fmt.Fprintf(w, " %s (%d/%d/%d) |", cell.Status, cell.Passed, cell.Failed, cell.Skipped)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "\nThe numbers are passed/failed/skipped tests.\n")
+
+	header := false
+	for _, driver := range m.Drivers {
+		for _, row := range m.Rows {
+			cell := row.Cells[driver]
+			if cell == nil || len(cell.Reasons) == 0 {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(w, "\n## Failures and Skips\n")
+				header = true
+			}
+			fmt.Fprintf(w, "\n### %s: %s, %s\n\n", driver, row.Suite, row.Pattern)
+			for _, reason := range cell.Reasons {
+				fmt.Fprintf(w, "- %s\n", reason)
+			}
+		}
+	}
+}
+
+var matrixHTML = template.Must(template.New("matrix").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CSI Conformance Matrix</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; vertical-align: top; }
+td.passed { background: #c8e6c9; }
+td.failed { background: #ffcdd2; }
+td.skipped { background: #eeeeee; }
+td ul { margin: 4px 0 0 0; padding-left: 16px; font-size: small; }
+</style>
+</head>
+<body>
+<h1>CSI Conformance Matrix</h1>
+<table>
+<tr><th>Suite</th><th>Pattern</th>{{range .Drivers}}<th>{{.}}</th>{{end}}</tr>
+{{range $row := .Rows}}<tr><td>{{$row.Suite}}</td><td>{{$row.Pattern}}</td>{{range $driver := $.Drivers}}{{with index $row.Cells $driver}}<td class="{{.Status}}">{{.Status}} ({{.Passed}}/{{.Failed}}/{{.Skipped}}){{if .Reasons}}<ul>{{range .Reasons}}<li>{{.}}</li>{{end}}</ul>{{end}}</td>{{else}}<td>not run</td>{{end}}{{end}}</tr>
+{{end}}</table>
+<p>The numbers are passed/failed/skipped tests.</p>
+</body>
+</html>
+`))
+
+// write stores the matrix as csi-matrix<suffix>.json, .md and .html
+// in the report directory.
+func (m *conformanceMatrix) write(suffix string) error {
+	dir := framework.TestContext.ReportDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fileName := path.Join(dir, "csi-matrix"+suffix)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileName+".json", data, 0644); err != nil {
+		return err
+	}
+	var markdown bytes.Buffer
+	m.writeMarkdown(&markdown)
+	if err := ioutil.WriteFile(fileName+".md", markdown.Bytes(), 0644); err != nil {
+		return err
+	}
+	var html bytes.Buffer
+	if err := matrixHTML.Execute(&html, m); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName+".html", html.Bytes(), 0644)
+}
+
+// matrixReporter builds the conformance matrix from the results of the
+// CSI tests and writes it into the report directory.
+type matrixReporter struct {
+	matrix conformanceMatrix
+}
+
+var _ ginkgo.Reporter = &matrixReporter{}
+
+// NewMatrixReporter returns a reporter which writes the conformance
+// matrix into the report directory at the end of the test run.
+func NewMatrixReporter() ginkgo.Reporter {
+	return &matrixReporter{}
+}
+
+func (r *matrixReporter) SpecSuiteWillBegin(config config.GinkgoConfigType, summary *types.SuiteSummary) {
+}
+
+func (r *matrixReporter) BeforeSuiteDidRun(setupSummary *types.SetupSummary) {
+}
+
+func (r *matrixReporter) SpecWillRun(specSummary *types.SpecSummary) {
+}
+
+func (r *matrixReporter) SpecDidComplete(specSummary *types.SpecSummary) {
+	// Tests excluded by -ginkgo.focus or -ginkgo.skip are
+	// skipped without a message and not part of the matrix.
+	if specSummary.State == types.SpecStateSkipped && specSummary.Failure.Message == "" ||
+		specSummary.State == types.SpecStatePending {
+		return
+	}
+	texts := specSummary.ComponentTexts
+	for i := 1; i < len(texts)-1; i++ {
+		if match := testPatternText.FindStringSubmatch(texts[i]); match != nil {
+			r.matrix.add(texts[i-1], match[2], match[1], strings.Join(texts[i+1:], " "),
+				specSummary.State, specSummary.Failure.Message)
+			return
+		}
+	}
+}
+
+func (r *matrixReporter) AfterSuiteDidRun(setupSummary *types.SetupSummary) {
+}
+
+func (r *matrixReporter) SpecSuiteDidEnd(summary *types.SuiteSummary) {
+	if len(r.matrix.Rows) == 0 {
+		return
+	}
+	r.matrix.sort()
+	// Each parallel Ginkgo node only sees its own tests.
+	suffix := ""
+	if config.GinkgoConfig.ParallelTotal > 1 {
+		suffix = fmt.Sprintf("_%02d", config.GinkgoConfig.ParallelNode)
+	}
+	if err := r.matrix.write(suffix); err != nil {
+		framework.Logf("writing conformance matrix failed: %v", err)
+		return
+	}
+	framework.Logf("conformance matrix written to %s", path.Join(framework.TestContext.ReportDir, "csi-matrix"+suffix+".{json,md,html}"))
+}
+
+// MatrixCompareEnabled returns true if -csi.matrix-compare was given.
+func MatrixCompareEnabled() bool {
+	return csiTestContext.matrixCompare != ""
+}
+
+// RunMatrixCompare compares the two conformance matrices given with
+// -csi.matrix-compare instead of running tests. It prints the
+// differences as Markdown, also to csi-matrix-diff.md in the report
+// directory if there is one, and fails if a combination which passed
+// in the old matrix no longer passes in the new one.
+func RunMatrixCompare(t *testing.T) {
+	files := strings.Split(csiTestContext.matrixCompare, ",")
+	if len(files) != 2 {
+		t.Fatalf("-csi.matrix-compare must be <old JSON file>,<new JSON file>, got %q", csiTestContext.matrixCompare)
+	}
+	var matrices [2]conformanceMatrix
+	for i, fileName := range files {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("reading conformance matrix: %v", err)
+		}
+		if err := json.Unmarshal(data, &matrices[i]); err != nil {
+			t.Fatalf("decoding conformance matrix %s: %v", fileName, err)
+		}
+	}
+
+	var diff bytes.Buffer
+	regressions := compareMatrices(&diff, &matrices[0], &matrices[1], files[0], files[1])
+	fmt.Print(diff.String())
+	if dir := framework.TestContext.ReportDir; dir != "" {
+		fileName := path.Join(dir, "csi-matrix-diff.md")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Errorf("creating %s: %v", dir, err)
+		} else if err := ioutil.WriteFile(fileName, diff.Bytes(), 0644); err != nil {
+			t.Errorf("writing %s: %v", fileName, err)
+		}
+	}
+	if regressions > 0 {
+		t.Errorf("%d regressions between %s and %s", regressions, files[0], files[1])
+	}
+}
+
+// compareMatrices writes a Markdown table with all combinations whose
+// status changed and returns the number of regressions.
+func compareMatrices(w io.Writer, oldMatrix, newMatrix *conformanceMatrix, oldName, newName string) int {
+	type key struct {
+		suite, pattern, driver string
+	}
+	var keys []key
+	seen := map[key]bool{}
+	for _, m := range []*conformanceMatrix{oldMatrix, newMatrix} {
+		for _, row := range m.Rows {
+			for driver := range row.Cells {
+				k := key{row.Suite, row.Pattern, driver}
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.driver != b.driver {
+			return a.driver < b.driver
+		}
+		if a.suite != b.suite {
+			return a.suite < b.suite
+		}
+		return a.pattern < b.pattern
+	})
+
+	fmt.Fprintf(w, "# CSI Conformance Matrix Changes\n\n%s -> %s\n\n", oldName, newName)
+	regressions, changes := 0, 0
+	for _, k := range keys {
+		before := oldMatrix.status(k.suite, k.pattern, k.driver)
+		after := newMatrix.status(k.suite, k.pattern, k.driver)
+		if before == after {
+			continue
+		}
+		if changes == 0 {
+			fmt.Fprintf(w, "| Driver | Suite | Pattern | Old | New | |\n|---|---|---|---|---|---|\n")
+		}
+		changes++
+		change := ""
+		switch {
+		case before == matrixPassed:
+			change = "REGRESSION"
+			regressions++
+		case after == matrixPassed:
+			change = "fixed"
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %s | %s | %s |\n", k.driver, k.suite, k.pattern, before, after, change)
+	}
+	if changes == 0 {
+		fmt.Fprintf(w, "No changes.\n")
+	} else {
+		fmt.Fprintf(w, "\n%d changes, %d regressions.\n", changes, regressions)
+	}
+	return regressions
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/onsi/ginkgo/types"
+)
+
+// matrixResult is the result of one test for conformanceMatrix.add.
+type matrixResult struct {
+	driver, suite, pattern, test string
+	state                        types.SpecState
+	message                      string
+}
+
+func newTestMatrix(results ...matrixResult) *conformanceMatrix {
+	m := &conformanceMatrix{}
+	for _, r := range results {
+		m.add(r.driver, r.suite, r.pattern, r.test, r.state, r.message)
+	}
+	m.sort()
+	return m
+}
+
+func TestConformanceMatrixAdd(t *testing.T) {
+	tests := map[string]struct {
+		results []matrixResult
+		matrix  *conformanceMatrix
+	}{
+		"passed": {
+			results: []matrixResult{
+				{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStatePassed, ""},
+				{"hostpath", "volumes", "Dynamic PV", "t2", types.SpecStatePassed, ""},
+			},
+			matrix: &conformanceMatrix{
+				Drivers: []string{"hostpath"},
+				Rows: []*matrixRow{
+					{Suite: "volumes", Pattern: "Dynamic PV", Cells: map[string]*matrixCell{
+						"hostpath": {Status: matrixPassed, Passed: 2},
+					}},
+				},
+			},
+		},
+		"skipped": {
+			results: []matrixResult{
+				{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStateSkipped, "Driver hostpath does not support it -- skipping\nstack"},
+				{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStateSkipped, "Driver hostpath does not support it -- skipping\nstack"},
+			},
+			matrix: &conformanceMatrix{
+				Drivers: []string{"hostpath"},
+				Rows: []*matrixRow{
+					{Suite: "volumes", Pattern: "Dynamic PV", Cells: map[string]*matrixCell{
+						"hostpath": {
+							Status:  matrixSkipped,
+							Skipped: 2,
+							Reasons: []string{"t1: Driver hostpath does not support it -- skipping"},
+						},
+					}},
+				},
+			},
+		},
+		"failed": {
+			results: []matrixResult{
+				{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStatePassed, ""},
+				{"hostpath", "volumes", "Dynamic PV", "t2", types.SpecStateFailed, "  no such file  "},
+				{"hostpath", "volumes", "Dynamic PV", "t3", types.SpecStateTimedOut, "timeout"},
+				{"hostpath", "volumes", "Dynamic PV", "t4", types.SpecStatePanicked, "nil pointer"},
+			},
+			matrix: &conformanceMatrix{
+				Drivers: []string{"hostpath"},
+				Rows: []*matrixRow{
+					{Suite: "volumes", Pattern: "Dynamic PV", Cells: map[string]*matrixCell{
+						"hostpath": {
+							Status: matrixFailed,
+							Passed: 1,
+							Failed: 3,
+							Reasons: []string{
+								"t2: failed: no such file",
+								"t3: timed out: timeout",
+								"t4: panicked: nil pointer",
+							},
+						},
+					}},
+				},
+			},
+		},
+		"rows and drivers": {
+			results: []matrixResult{
+				{"b", "volumes", "Inline", "t1", types.SpecStatePassed, ""},
+				{"a", "volumes", "Inline", "t1", types.SpecStatePassed, ""},
+				{"b", "provisioning", "Dynamic PV", "t1", types.SpecStateSkipped, "skip"},
+			},
+			matrix: &conformanceMatrix{
+				Drivers: []string{"a", "b"},
+				Rows: []*matrixRow{
+					{Suite: "provisioning", Pattern: "Dynamic PV", Cells: map[string]*matrixCell{
+						"b": {Status: matrixSkipped, Skipped: 1, Reasons: []string{"t1: skip"}},
+					}},
+					{Suite: "volumes", Pattern: "Inline", Cells: map[string]*matrixCell{
+						"a": {Status: matrixPassed, Passed: 1},
+						"b": {Status: matrixPassed, Passed: 1},
+					}},
+				},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			matrix := newTestMatrix(test.results...)
+			if !reflect.DeepEqual(matrix, test.matrix) {
+				t.Errorf("expected matrix %s, got: %s", dumpMatrix(test.matrix), dumpMatrix(matrix))
+			}
+		})
+	}
+}
+
+func dumpMatrix(m *conformanceMatrix) string {
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+func TestCompareMatrices(t *testing.T) {
+	passed := matrixResult{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStatePassed, ""}
+	failed := matrixResult{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStateFailed, "error"}
+	skipped := matrixResult{"hostpath", "volumes", "Dynamic PV", "t1", types.SpecStateSkipped, "skip"}
+	other := matrixResult{"other", "volumes", "Dynamic PV", "t1", types.SpecStatePassed, ""}
+	header := "# CSI Conformance Matrix Changes\n\nold -> new\n\n"
+	table := "| Driver | Suite | Pattern | Old | New | |\n|---|---|---|---|---|---|\n"
+
+	tests := map[string]struct {
+		old, new    []matrixResult
+		regressions int
+		output      string
+	}{
+		"no changes": {
+			old:    []matrixResult{passed, other},
+			new:    []matrixResult{passed, other},
+			output: header + "No changes.\n",
+		},
+		"regression": {
+			old:         []matrixResult{passed},
+			new:         []matrixResult{failed},
+			regressions: 1,
+			output: header + table +
+				"| hostpath | volumes | Dynamic PV | passed | failed | REGRESSION |\n" +
+				"\n1 changes, 1 regressions.\n",
+		},
+		"fixed": {
+			old: []matrixResult{skipped},
+			new: []matrixResult{passed},
+			output: header + table +
+				"| hostpath | volumes | Dynamic PV | skipped | passed | fixed |\n" +
+				"\n1 changes, 0 regressions.\n",
+		},
+		"not run": {
+			old:         []matrixResult{passed},
+			new:         []matrixResult{other},
+			regressions: 1,
+			output: header + table +
+				"| hostpath | volumes | Dynamic PV | passed | not run | REGRESSION |\n" +
+				"| other | volumes | Dynamic PV | not run | passed | fixed |\n" +
+				"\n2 changes, 1 regressions.\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var output bytes.Buffer
+			regressions := compareMatrices(&output, newTestMatrix(test.old...), newTestMatrix(test.new...), "old", "new")
+			if regressions != test.regressions {
+				t.Errorf("expected %d regressions, got %d", test.regressions, regressions)
+			}
+			if output.String() != test.output {
+				t.Errorf("expected output:\n%s\ngot:\n%s", test.output, output.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// persistenceDataKiB is the amount of random data written by the
+// persistence tests. It must fit into the claim size of the driver.
+const persistenceDataKiB = 512
+
+// writeRandomData fills /mnt/test/data with random data in a pod on
+// the node and returns the SHA256 checksum of that data.
+func writeRandomData(cs clientset.Interface, pvc *v1.PersistentVolumeClaim, nodeName string) string {
+	By(fmt.Sprintf("writing %d KiB of random data on node %s", persistenceDataKiB, nodeName))
+	output := runInPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName,
+		fmt.Sprintf("dd if=/dev/urandom of=/mnt/test/data bs=1024 count=%d 2>/dev/null && sha256sum /mnt/test/data", persistenceDataKiB))
+	fields := strings.Fields(output)
+	Expect(fields).NotTo(BeEmpty(), "sha256sum output")
+	return fields[0]
+}
+
+// readDataChecksum returns the SHA256 checksum of /mnt/test/data as
+// seen by a new pod on the node, or an empty string if the file does
+// not exist.
+func readDataChecksum(cs clientset.Interface, pvc *v1.PersistentVolumeClaim, nodeName string) string {
+	By(fmt.Sprintf("reading the data on node %s", nodeName))
+	output := runInPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName,
+		"if [ -e /mnt/test/data ]; then sha256sum /mnt/test/data; fi")
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+type persistenceTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &persistenceTestSuite{}
+
+// initPersistenceTestSuite returns persistenceTestSuite that implements csiTestSuite interface
+func initPersistenceTestSuite() csiTestSuite {
+	return &persistenceTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "persistence",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *persistenceTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *persistenceTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *persistenceTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		// checkData compares the checksum read by a new pod
+		// against the one of the written data: it must be the
+		// same for persistent volumes and the data must be gone
+		// for drivers which are not persistent.
+		checkData := func(written, read string) {
+			if driver.driverInfo.IsPersistent {
+				Expect(read).To(Equal(written), "checksum of the data in the new pod")
+			} else {
+				Expect(read).To(BeEmpty(), "data of non-persistent driver in the new pod")
+			}
+		}
+
+		It("should keep data when the pod gets replaced on the same node", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			pvc, _ := resource.createBoundClaim("")
+			written := writeRandomData(cs, pvc, nodeName)
+			checkData(written, readDataChecksum(cs, pvc, nodeName))
+		})
+
+		It("should keep data when the pod moves to another node", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodes := getClientNodes(driver, 2)
+			if len(nodes) < 2 {
+				framework.Skipf("Driver %s can only be used on one node -- skipping", driver.driverInfo.Name)
+			}
+
+			pvc, _ := resource.createBoundClaim("")
+			written := writeRandomData(cs, pvc, nodes[0])
+			checkData(written, readDataChecksum(cs, pvc, nodes[1]))
+		})
+
+		It("should keep data when the driver gets restarted", func() {
+			if driver.restartLosesData {
+				framework.Skipf("Driver %s loses data when restarted -- skipping", driver.driverInfo.Name)
+			}
+			if driver.driverPods == (driverPodLabels{}) {
+				framework.Skipf("Driver %s has no driverPods -- skipping", driver.driverInfo.Name)
+			}
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			pvc, _ := resource.createBoundClaim("")
+			written := writeRandomData(cs, pvc, nodeName)
+
+			By("restarting the driver")
+			for _, app := range []string{driver.driverPods.provisioner, driver.driverPods.attacher, driver.driverPods.plugin} {
+				if app != "" {
+					restartDriverPod(driver, app)
+				}
+			}
+			if driver.driverPods.plugin != "" {
+				waitForRegistration(driver, nodeName, true)
+			}
+			checkData(written, readDataChecksum(cs, pvc, nodeName))
+		})
+	})
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/kubernetes/test/e2e/framework"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// The values of -csi.pod-logs.
+const (
+	podLogsAlways    = "always"
+	podLogsOnFailure = "on-failure"
+)
+
+// glogLevels maps the -csi.pod-logs-level values to the first
+// character of glog lines with that or a higher severity.
+var glogLevels = map[string]string{
+	"info":    "IWEF",
+	"warning": "WEF",
+	"error":   "EF",
+}
+
+// glogHeader matches the beginning of a glog line, for example
+// "I1019 10:11:12.123456".
+var glogHeader = regexp.MustCompile(`^([IWEF])\d{4} `)
+
+// lineBuffer keeps the most recent lines up to a certain size.
+type lineBuffer struct {
+	lines   []string
+	size    int64
+	dropped int
+}
+
+func (b *lineBuffer) add(line string, maxSize int64) {
+	b.lines = append(b.lines, line)
+	b.size += int64(len(line)) + 1
+	for b.size > maxSize && len(b.lines) > 1 {
+		b.size -= int64(len(b.lines[0])) + 1
+		b.lines = b.lines[1:]
+		b.dropped++
+	}
+}
+
+// write prints at most tail lines, all lines if tail is zero.
+func (b *lineBuffer) write(w io.Writer, tail int) {
+	lines := b.lines
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	if skipped := b.dropped + len(b.lines) - len(lines); skipped > 0 {
+		fmt.Fprintf(w, "... %d earlier lines skipped ...\n", skipped)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// podLogBuffer collects the pod logs and pod events of one test in
+// memory for -csi.pod-logs=on-failure. The logs arrive as lines with
+// a "<pod>/<container>: " prefix from podlogs.CopyAllLogs.
+type podLogBuffer struct {
+	mutex      sync.Mutex
+	containers map[string]*lineBuffer
+	events     lineBuffer
+
+	maxSize int64
+	tail    int
+	// Empty if all containers are logged.
+	only sets.String
+	// Empty if all levels are logged.
+	levels string
+}
+
+var _ io.Writer = &podLogBuffer{}
+
+// newPodLogBuffer creates a buffer as configured by the
+// -csi.pod-logs-* flags.
+func newPodLogBuffer() (*podLogBuffer, error) {
+	b := &podLogBuffer{
+		containers: map[string]*lineBuffer{},
+		maxSize:    csiTestContext.podLogsMaxBytes,
+		tail:       csiTestContext.podLogsTail,
+		only:       sets.NewString(),
+	}
+	for _, name := range strings.Split(csiTestContext.podLogsContainers, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			b.only.Insert(name)
+		}
+	}
+	if level := csiTestContext.podLogsLevel; level != "" {
+		levels, ok := glogLevels[level]
+		if !ok {
+			return nil, fmt.Errorf("unknown -csi.pod-logs-level %q, must be one of info, warning, error", level)
+		}
+		b.levels = levels
+	}
+	return b, nil
+}
+
+func (b *podLogBuffer) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, text := parts[0], parts[1]
+		if b.only.Len() > 0 && !b.only.Has(path.Base(name)) {
+			continue
+		}
+		// Lines without glog header, for example stack
+		// traces, are always kept.
+		if match := glogHeader.FindStringSubmatch(text); b.levels != "" && match != nil && !strings.Contains(b.levels, match[1]) {
+			continue
+		}
+		buffer := b.containers[name]
+		if buffer == nil {
+			buffer = &lineBuffer{}
+			b.containers[name] = buffer
+		}
+		buffer.add(text, b.maxSize)
+	}
+	return len(data), nil
+}
+
+// eventWriter returns a writer for podlogs.WatchPods.
+func (b *podLogBuffer) eventWriter() io.Writer {
+	return podEventBuffer{b}
+}
+
+type podEventBuffer struct {
+	*podLogBuffer
+}
+
+func (e podEventBuffer) Write(data []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		e.events.add(line, e.maxSize)
+	}
+	return len(data), nil
+}
+
+// dump writes the buffered output of the failed test. With a report
+// directory, it goes into the same files as without
+// -csi.pod-logs=on-failure, otherwise to the GinkgoWriter.
+func (b *podLogBuffer) dump() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var names []string
+	for name := range b.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if framework.TestContext.ReportDir == "" {
+		for _, name := range names {
+			fmt.Fprintf(GinkgoWriter, "==== log of container %s ====\n", name)
+			b.containers[name].write(GinkgoWriter, b.tail)
+		}
+		fmt.Fprintf(GinkgoWriter, "==== pod events ====\n")
+		b.events.write(GinkgoWriter, b.tail)
+		return
+	}
+
+	dir := path.Join(framework.TestContext.ReportDir, testFileName())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		framework.Logf("creating %s failed: %v", dir, err)
+		return
+	}
+	writeFile := func(fileName string, buffer *lineBuffer) {
+		file, err := os.OpenFile(path.Join(dir, fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			framework.Logf("creating pod log file failed: %v", err)
+			return
+		}
+		defer file.Close()
+		buffer.write(file, b.tail)
+	}
+	for _, name := range names {
+		writeFile(strings.Replace(name, "/", "-", 1)+".log", b.containers[name])
+	}
+	writeFile("pod-events.log", &b.events)
+	framework.Logf("pod logs of the failed test written to %s", dir)
+}
+
+// podLogFiles writes the output of podlogs.CopyAllLogs into one file
+// per container, like podlogs does itself when given a
+// LogPathPrefix. It is used when the output also has to go somewhere
+// else.
+type podLogFiles struct {
+	mutex  sync.Mutex
+	prefix string
+	files  map[string]*os.File
+	// Output which arrives after Close is dropped.
+	closed bool
+}
+
+var _ io.WriteCloser = &podLogFiles{}
+
+func newPodLogFiles(prefix string) *podLogFiles {
+	return &podLogFiles{
+		prefix: prefix,
+		files:  map[string]*os.File{},
+	}
+}
+
+func (p *podLogFiles) Write(data []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return len(data), nil
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, text := parts[0], parts[1]
+		file := p.files[name]
+		if file == nil {
+			var err error
+			// The same test might run more than once, so
+			// append.
+			file, err = os.OpenFile(p.prefix+strings.Replace(name, "/", "-", 1)+".log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return 0, err
+			}
+			p.files[name] = file
+			fmt.Fprintf(file, "==== start of log for container %s ====\n", name)
+		}
+		fmt.Fprintln(file, text)
+	}
+	return len(data), nil
+}
+
+func (p *podLogFiles) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	var firstErr error
+	for name, file := range p.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.files, name)
+	}
+	return firstErr
+}
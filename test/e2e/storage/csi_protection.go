@@ -0,0 +1,301 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// protectionCheckDuration is how long the protection tests
+	// check that a deleted object is kept by its finalizer.
+	protectionCheckDuration = 15 * time.Second
+
+	// teardownTimeout is how long the protection tests wait for
+	// a volume to be detached and deleted.
+	teardownTimeout = 5 * time.Minute
+)
+
+// getVolumeAttachment returns the VolumeAttachment for the PV, nil if
+// there is none.
+func getVolumeAttachment(cs clientset.Interface, pvName string) (*storagev1beta1.VolumeAttachment, error) {
+	attachments, err := cs.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range attachments.Items {
+		attachment := &attachments.Items[i]
+		if source := attachment.Spec.Source.PersistentVolumeName; source != nil && *source == pvName {
+			return attachment, nil
+		}
+	}
+	return nil, nil
+}
+
+// expectClaimTerminating checks that the claim was marked for
+// deletion and does not go away for a while.
+func expectClaimTerminating(cs clientset.Interface, pvc *v1.PersistentVolumeClaim) {
+	By(fmt.Sprintf("checking that claim %s is kept while in use", pvc.Name))
+	Consistently(func() (*metav1.Time, error) {
+		claim, err := cs.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(pvc.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return claim.DeletionTimestamp, nil
+	}, protectionCheckDuration, framework.Poll).ShouldNot(BeNil(), "deletion timestamp of claim %s", pvc.Name)
+}
+
+// expectVolumeTerminating checks that the PV was marked for deletion
+// and stays bound for a while.
+func expectVolumeTerminating(cs clientset.Interface, pv *v1.PersistentVolume) {
+	By(fmt.Sprintf("checking that PV %s is kept while bound", pv.Name))
+	Consistently(func() (string, error) {
+		volume, err := cs.CoreV1().PersistentVolumes().Get(pv.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if volume.DeletionTimestamp == nil {
+			return "not marked for deletion", nil
+		}
+		return string(volume.Status.Phase), nil
+	}, protectionCheckDuration, framework.Poll).Should(Equal(string(v1.VolumeBound)), "PV %s", pv.Name)
+}
+
+// waitForVolumeTeardown waits until the PV is gone and checks that
+// the claim and the VolumeAttachment of the PV were removed before it.
+// Changes within the same poll interval cannot be ordered.
+func waitForVolumeTeardown(cs clientset.Interface, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) {
+	By(fmt.Sprintf("waiting for PV %s to be detached and deleted", pv.Name))
+	var events []string
+	claimGone, attachmentGone := false, false
+	err := wait.PollImmediate(time.Second, teardownTimeout, func() (bool, error) {
+		// The PV must be checked first, otherwise it might
+		// disappear after checking the other objects.
+		_, err := cs.CoreV1().PersistentVolumes().Get(pv.Name, metav1.GetOptions{})
+		volumeGone := apierrs.IsNotFound(err)
+		if err != nil && !volumeGone {
+			return false, err
+		}
+		if !claimGone {
+			_, err := cs.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(pvc.Name, metav1.GetOptions{})
+			if err != nil && !apierrs.IsNotFound(err) {
+				return false, err
+			}
+			if claimGone = err != nil; claimGone {
+				events = append(events, "claim removed")
+			}
+		}
+		if !attachmentGone {
+			attachment, err := getVolumeAttachment(cs, pv.Name)
+			if err != nil {
+				return false, err
+			}
+			if attachmentGone = attachment == nil; attachmentGone {
+				events = append(events, "VolumeAttachment removed")
+			}
+		}
+		if volumeGone {
+			events = append(events, "PV removed")
+		}
+		return volumeGone, nil
+	})
+	framework.Logf("teardown of PV %s: %s", pv.Name, strings.Join(events, ", "))
+	framework.ExpectNoError(err, "PV %s not deleted", pv.Name)
+	// The claim and the VolumeAttachment go away independently
+	// of each other once the pod is gone, but both before the PV.
+	Expect(events).To(Or(
+		Equal([]string{"claim removed", "VolumeAttachment removed", "PV removed"}),
+		Equal([]string{"VolumeAttachment removed", "claim removed", "PV removed"})),
+		"order of object removal")
+}
+
+type protectionTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &protectionTestSuite{}
+
+// initProtectionTestSuite returns protectionTestSuite that implements csiTestSuite interface
+func initProtectionTestSuite() csiTestSuite {
+	return &protectionTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "protection",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *protectionTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *protectionTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *protectionTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+			pod          *v1.Pod
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+			pod = nil
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				f := driver.driverInfo.Config.Framework
+				if pod != nil {
+					framework.ExpectNoError(framework.DeletePodWithWait(f, f.ClientSet, pod))
+				}
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		// startPod creates a bound claim and a running pod which
+		// uses it.
+		startPod := func() (*v1.PersistentVolumeClaim, *v1.PersistentVolume) {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			pvc, pv := resource.createBoundClaim("")
+			pod = createPodWithCSIVolume(cs, pvc.Namespace, nodeName, pvc, false)
+			return pvc, pv
+		}
+
+		// deletePod deletes the pod started by startPod.
+		deletePod := func() {
+			f := driver.driverInfo.Config.Framework
+			By(fmt.Sprintf("deleting pod %s", pod.Name))
+			framework.ExpectNoError(framework.DeletePodWithWait(f, f.ClientSet, pod))
+			pod = nil
+		}
+
+		// deleteClaim deletes the claim without waiting for it.
+		deleteClaim := func(pvc *v1.PersistentVolumeClaim) {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			By(fmt.Sprintf("deleting claim %s", pvc.Name))
+			err := cs.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(pvc.Name, nil)
+			framework.ExpectNoError(err, "delete claim %s", pvc.Name)
+		}
+
+		It("should keep a claim in use by a pod until the pod is gone", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			pvc, pv := startPod()
+
+			deleteClaim(pvc)
+			expectClaimTerminating(cs, pvc)
+			if driver.volumeExists != nil {
+				Expect(driver.volumeExists(driver, pv.Spec.CSI.VolumeHandle)).To(BeTrue(), "backend volume of terminating claim")
+			}
+			if driver.hasCSIProxy() {
+				trace, err := getProxyTrace(driver)
+				framework.ExpectNoError(err)
+				Expect(trace).To(haveNoCallsOf("DeleteVolume"))
+			}
+
+			deletePod()
+			err := framework.WaitForPersistentVolumeDeleted(cs, pv.Name, framework.Poll, teardownTimeout)
+			framework.ExpectNoError(err, "PV %s not deleted", pv.Name)
+		})
+
+		It("should keep a bound PV when it gets deleted directly", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			_, pv := resource.createBoundClaim("")
+
+			By(fmt.Sprintf("deleting PV %s", pv.Name))
+			err := cs.CoreV1().PersistentVolumes().Delete(pv.Name, nil)
+			framework.ExpectNoError(err, "delete PV %s", pv.Name)
+			expectVolumeTerminating(cs, pv)
+		})
+
+		It("should unpublish, detach and delete a volume in the right order", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			pvc, pv := startPod()
+
+			By(fmt.Sprintf("waiting for PV %s to be attached", pv.Name))
+			Eventually(func() (bool, error) {
+				attachment, err := getVolumeAttachment(cs, pv.Name)
+				return attachment != nil && attachment.Status.Attached, err
+			}, framework.PodStartTimeout, framework.Poll).Should(BeTrue(), "VolumeAttachment for PV %s attached", pv.Name)
+
+			deleteClaim(pvc)
+			deletePod()
+			waitForVolumeTeardown(cs, pvc, pv)
+			if driver.hasCSIProxy() {
+				trace, err := getProxyTrace(driver)
+				framework.ExpectNoError(err)
+				Expect(trace).To(haveCallBefore("NodeUnpublishVolume", "ControllerUnpublishVolume"))
+				Expect(trace).To(haveCallBefore("NodeUnpublishVolume", "DeleteVolume"))
+				Expect(trace).To(haveNoFailedCallsExceptInjected())
+			}
+		})
+
+		It("should recover protected volumes after reinstalling the driver", func() {
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			pvc, pv := startPod()
+
+			By("writing data")
+			container := pod.Spec.Containers[0].Name
+			written, _, err := f.ExecCommandInContainerWithFullOutput(pod.Name, container,
+				"sh", "-c", fmt.Sprintf("dd if=/dev/urandom of=%[1]s bs=1024 count=64 2>/dev/null && sha256sum %[1]s", podVolumePath+"/data"))
+			framework.ExpectNoError(err, "write data")
+			deleteClaim(pvc)
+
+			driver.reinstallDriver()
+			if driver.driverPods.plugin != "" {
+				waitForRegistration(driver, nodeName, true)
+			}
+			expectClaimTerminating(cs, pvc)
+			if !driver.restartLosesData {
+				By("reading data")
+				read, _, err := f.ExecCommandInContainerWithFullOutput(pod.Name, container, "sha256sum", podVolumePath+"/data")
+				framework.ExpectNoError(err, "read data")
+				Expect(read).To(Equal(written), "checksum of the data")
+			}
+
+			deletePod()
+			waitForVolumeTeardown(cs, pvc, pv)
+		})
+	})
+}
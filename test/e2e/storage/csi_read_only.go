@@ -0,0 +1,195 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// getMountOptions returns the mount options of the volume in the pod
+// from /proc/mounts.
+func getMountOptions(f *framework.Framework, pod *v1.Pod) []string {
+	stdout, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, pod.Spec.Containers[0].Name, "cat", "/proc/mounts")
+	framework.ExpectNoError(err, "read /proc/mounts: %s", stderr)
+	for _, line := range strings.Split(stdout, "\n") {
+		// device mount-point fs-type options dump pass
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == podVolumePath {
+			framework.Logf("pod %s: %s", pod.Name, line)
+			return strings.Split(fields[3], ",")
+		}
+	}
+	framework.Failf("pod %s: %s not found in /proc/mounts:\n%s", pod.Name, podVolumePath, stdout)
+	return nil
+}
+
+// writeInPod tries to write a file into the volume and returns the
+// error output if that fails.
+func writeInPod(f *framework.Framework, pod *v1.Pod, fileName string) (string, error) {
+	_, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, pod.Spec.Containers[0].Name,
+		"sh", "-c", "echo hello > "+podVolumePath+"/"+fileName)
+	return stderr, err
+}
+
+// expectReadOnly checks that the volume is mounted read-only in the
+// pod and that writing fails with EROFS.
+func expectReadOnly(f *framework.Framework, pod *v1.Pod) {
+	By("checking that the volume is read-only in pod " + pod.Name)
+	Expect(getMountOptions(f, pod)).To(ContainElement("ro"), "mount options")
+	stderr, err := writeInPod(f, pod, "read-only-test")
+	Expect(err).To(HaveOccurred(), "writing into read-only volume")
+	Expect(stderr).To(ContainSubstring("Read-only file system"), "error for writing into read-only volume")
+}
+
+// expectReadWrite checks that the volume is mounted read-write in the
+// pod and that writing works.
+func expectReadWrite(f *framework.Framework, pod *v1.Pod) {
+	By("checking that the volume is writable in pod " + pod.Name)
+	Expect(getMountOptions(f, pod)).To(ContainElement("rw"), "mount options")
+	stderr, err := writeInPod(f, pod, "read-write-test")
+	framework.ExpectNoError(err, "writing into volume: %s", stderr)
+}
+
+type readOnlyTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &readOnlyTestSuite{}
+
+// initReadOnlyTestSuite returns readOnlyTestSuite that implements csiTestSuite interface
+func initReadOnlyTestSuite() csiTestSuite {
+	return &readOnlyTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "read-only",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *readOnlyTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *readOnlyTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *readOnlyTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+			pods         []*v1.Pod
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+			pods = nil
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				f := driver.driverInfo.Config.Framework
+				for _, pod := range pods {
+					framework.ExpectNoError(framework.DeletePodWithWait(f, f.ClientSet, pod))
+				}
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		// createPod starts a pod with the claim mounted read-only
+		// either via the pod volume (readOnlyVolume) or via the
+		// volume mount of the container (readOnlyMount).
+		createPod := func(pvc *v1.PersistentVolumeClaim, readOnlyVolume, readOnlyMount bool) *v1.Pod {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			pod := framework.MakePod(pvc.Namespace, nil, []*v1.PersistentVolumeClaim{pvc}, false, "")
+			pod.Spec.NodeName = driver.driverInfo.Config.ClientNodeName
+			pod.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly = readOnlyVolume
+			pod.Spec.Containers[0].VolumeMounts[0].ReadOnly = readOnlyMount
+			pod = createRunningPod(cs, pod)
+			pods = append(pods, pod)
+			return pod
+		}
+
+		// expectNodePublishReadOnly checks the readonly flag of
+		// NodePublishVolume if the calls are traced.
+		expectNodePublishReadOnly := func(pv *v1.PersistentVolume, readOnly bool) {
+			if !driver.hasCSIProxy() {
+				return
+			}
+			value := "<nil>"
+			if readOnly {
+				value = "1"
+			}
+			trace, err := getProxyTrace(driver)
+			framework.ExpectNoError(err)
+			Expect(trace).To(haveCallWithFields("NodePublishVolume", map[string]string{
+				"volume_id": pv.Spec.CSI.VolumeHandle,
+				"readonly":  value,
+			}))
+		}
+
+		It("should mount a read-only pod volume read-only", func() {
+			f := driver.driverInfo.Config.Framework
+			pvc, pv := resource.createBoundClaim("")
+
+			pod := createPod(pvc, true, false)
+			expectReadOnly(f, pod)
+			expectNodePublishReadOnly(pv, true)
+		})
+
+		It("should mount a read-only volume mount read-only", func() {
+			f := driver.driverInfo.Config.Framework
+			pvc, _ := resource.createBoundClaim("")
+
+			pod := createPod(pvc, false, true)
+			expectReadOnly(f, pod)
+		})
+
+		It("should use independent mount flags for read-write and read-only pods on the same node", func() {
+			f := driver.driverInfo.Config.Framework
+			pvc, pv := resource.createBoundClaim("")
+
+			writer := createPod(pvc, false, false)
+			reader := createPod(pvc, true, false)
+			expectReadWrite(f, writer)
+			expectReadOnly(f, reader)
+
+			By("reading the data written by the read-write pod")
+			stdout, stderr, err := f.ExecCommandInContainerWithFullOutput(reader.Name, reader.Spec.Containers[0].Name,
+				"cat", podVolumePath+"/read-write-test")
+			framework.ExpectNoError(err, "read data: %s", stderr)
+			Expect(stdout).To(Equal("hello"), "data written by the read-write pod")
+			expectNodePublishReadOnly(pv, false)
+			expectNodePublishReadOnly(pv, true)
+		})
+	})
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// backendVolumeTimeout is how long the reclaim policy tests
+	// wait for a volume to disappear from the storage backend.
+	backendVolumeTimeout = 2 * time.Minute
+
+	// retainedVolumeCheck is how long the backend volume of a
+	// released PV with reclaim policy Retain must remain.
+	retainedVolumeCheck = 10 * time.Second
+)
+
+type reclaimPolicyTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &reclaimPolicyTestSuite{}
+
+// initReclaimPolicyTestSuite returns reclaimPolicyTestSuite that implements csiTestSuite interface
+func initReclaimPolicyTestSuite() csiTestSuite {
+	return &reclaimPolicyTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "reclaim policy",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *reclaimPolicyTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *reclaimPolicyTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if driver.volumeExists == nil {
+		framework.Skipf("Driver %s cannot check volumes in its storage backend -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *reclaimPolicyTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		// init sets up a StorageClass with the given reclaim policy.
+		init := func(reclaimPolicy v1.PersistentVolumeReclaimPolicy) {
+			resource = csiVolumeTestResource{
+				reclaimPolicy: reclaimPolicy,
+			}
+			resource.setupResource(driver, pattern)
+		}
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should remove PV and backend volume with reclaim policy Delete", func() {
+			init(v1.PersistentVolumeReclaimDelete)
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			pvc, pv := resource.createBoundClaim("")
+			handle := pv.Spec.CSI.VolumeHandle
+			runInPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName, "echo hello > /mnt/test/data")
+			Expect(driver.volumeExists(driver, handle)).To(BeTrue(), "backend volume %s after provisioning", handle)
+
+			By("deleting the claim")
+			err := framework.DeletePersistentVolumeClaim(cs, pvc.Name, pvc.Namespace)
+			Expect(err).NotTo(HaveOccurred())
+			err = framework.WaitForPersistentVolumeDeleted(cs, pv.Name, 5*time.Second, 5*time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("checking the backend volume")
+			waitForBackendVolume(driver, handle, false)
+		})
+
+		It("should keep PV and data with reclaim policy Retain and allow rebinding", func() {
+			init(v1.PersistentVolumeReclaimRetain)
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			content := fmt.Sprintf("retained data of %s", f.Namespace.Name)
+
+			pvc, pv := resource.createBoundClaim("")
+			handle := pv.Spec.CSI.VolumeHandle
+			runInPodWithCSIVolume(cs, pvc.Namespace, pvc.Name, nodeName, fmt.Sprintf("echo '%s' > /mnt/test/data", content))
+
+			By("deleting the claim")
+			err := framework.DeletePersistentVolumeClaim(cs, pvc.Name, pvc.Namespace)
+			Expect(err).NotTo(HaveOccurred())
+			err = framework.WaitForPersistentVolumePhase(v1.VolumeReleased, cs, pv.Name, framework.Poll, framework.PVReclaimingTimeout)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("checking the backend volume")
+			// A (wrong) asynchronous delete would remove it soon
+			// after the release.
+			Consistently(func() bool {
+				return driver.volumeExists(driver, handle)
+			}, retainedVolumeCheck, framework.Poll).Should(BeTrue(), "backend volume %s of released PV", handle)
+
+			By("making the released PV available again")
+			pv, err = cs.CoreV1().PersistentVolumes().Get(pv.Name, metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			pv.Spec.ClaimRef = nil
+			pv, err = cs.CoreV1().PersistentVolumes().Update(pv)
+			Expect(err).NotTo(HaveOccurred())
+			err = framework.WaitForPersistentVolumePhase(v1.VolumeAvailable, cs, pv.Name, framework.Poll, framework.PVReclaimingTimeout)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("binding a new claim to the PV")
+			claim := getCSIClaim(driver.GetClaimSize(), f.Namespace.Name, resource.sc.Name)
+			claim.Spec.VolumeName = pv.Name
+			claim, err = cs.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(claim)
+			Expect(err).NotTo(HaveOccurred())
+			resource.pvcs = append(resource.pvcs, claim)
+			err = framework.WaitForPersistentVolumeClaimPhase(v1.ClaimBound, cs, claim.Namespace, claim.Name, framework.Poll, framework.ClaimBindingTimeout)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("reading the data through the new claim")
+			runInPodWithCSIVolume(cs, claim.Namespace, claim.Name, nodeName, fmt.Sprintf("grep -x '%s' /mnt/test/data", content))
+		})
+	})
+}
+
+// waitForBackendVolume waits until the volume with the given handle
+// exists or doesn't exist in the storage backend of the driver.
+func waitForBackendVolume(driver *manifestDriver, handle string, exists bool) {
+	err := wait.PollImmediate(framework.Poll, backendVolumeTimeout, func() (bool, error) {
+		return driver.volumeExists(driver, handle) == exists, nil
+	})
+	Expect(err).NotTo(HaveOccurred(), "backend volume %s should exist: %v", handle, exists)
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// nodeIDAnnotation is set by kubelet for each registered
+	// CSI driver. It contains a JSON map from driver name to
+	// node ID.
+	nodeIDAnnotation = "csi.volume.kubernetes.io/nodeid"
+
+	// registrationTimeout is how long the tests wait for
+	// kubelet to add or remove a driver registration.
+	registrationTimeout = 2 * time.Minute
+)
+
+type registrationTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &registrationTestSuite{}
+
+// initRegistrationTestSuite returns registrationTestSuite that implements csiTestSuite interface
+func initRegistrationTestSuite() csiTestSuite {
+	return &registrationTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "node registration",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *registrationTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *registrationTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *registrationTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		BeforeEach(func() {
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+		})
+
+		It("should register the driver on the node", func() {
+			f := driver.driverInfo.Config.Framework
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			waitForRegistration(driver, nodeName, true)
+			checkStaleRegistrations(f, nodeName, driver.patchOptions.NewDriverName)
+		})
+
+		It("should re-register the driver after the registrar restarts", func() {
+			app := driver.driverPods.plugin
+			if app == "" {
+				framework.Skipf("Driver %s has no node plugin pod -- skipping", driver.driverInfo.Name)
+			}
+			f := driver.driverInfo.Config.Framework
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			waitForRegistration(driver, nodeName, true)
+			// The registration would not change when the
+			// driver registers again with the same node ID,
+			// so it gets removed first. Only kubelet adds it
+			// again, after the restarted registrar told it
+			// about the driver.
+			removeDriverRegistration(f, nodeName, driver.finalPatchOptions().NewDriverName)
+			restartDriverPod(driver, app)
+			waitForRegistration(driver, nodeName, true)
+
+			By("using the re-registered driver")
+			resource := csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+			defer resource.cleanupResource(driver, pattern)
+			pvc, _ := resource.createBoundClaim("")
+			runInPodWithCSIVolume(f.ClientSet, pvc.Namespace, pvc.Name, nodeName, "echo hello > /mnt/test/data")
+		})
+
+		It("should remove the registration when the driver gets uninstalled", func() {
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			waitForRegistration(driver, nodeName, true)
+			driver.CleanupDriver()
+			waitForRegistration(driver, nodeName, false)
+		})
+	})
+}
+
+// driverRegistration describes how a driver is registered for a node.
+type driverRegistration struct {
+	// The node ID from the node annotation, empty if not found.
+	annotationNodeID string
+	// The node ID and topology keys from the CSINodeInfo object,
+	// if that object exists and contains the driver.
+	nodeInfoNodeID       string
+	nodeInfoTopologyKeys []string
+}
+
+func (r driverRegistration) registered() bool {
+	return r.annotationNodeID != "" || r.nodeInfoNodeID != ""
+}
+
+// getDriverRegistrations returns the node ID annotation as map and
+// the registration of the driver. The CSINodeInfo object is
+// optional because the CRD might not be installed.
+func getDriverRegistrations(f *framework.Framework, nodeName, driverName string) (map[string]string, driverRegistration) {
+	var registration driverRegistration
+	node, err := f.ClientSet.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	framework.ExpectNoError(err, "get node %s", nodeName)
+	nodeIDs := map[string]string{}
+	if value, ok := node.Annotations[nodeIDAnnotation]; ok {
+		err := json.Unmarshal([]byte(value), &nodeIDs)
+		framework.ExpectNoError(err, "parse %s annotation %q of node %s", nodeIDAnnotation, value, nodeName)
+		registration.annotationNodeID = nodeIDs[driverName]
+	}
+
+	nodeInfo, err := f.CSIClientSet.CsiV1alpha1().CSINodeInfos().Get(nodeName, metav1.GetOptions{})
+	if err != nil && !apierrs.IsNotFound(err) {
+		framework.ExpectNoError(err, "get CSINodeInfo %s", nodeName)
+	}
+	if err == nil {
+		for _, info := range nodeInfo.Spec.Drivers {
+			if info.Name == driverName {
+				registration.nodeInfoNodeID = info.NodeID
+				registration.nodeInfoTopologyKeys = info.TopologyKeys
+			}
+		}
+	}
+	return nodeIDs, registration
+}
+
+// removeDriverRegistration removes the driver from the node ID
+// annotation and from the CSINodeInfo object of the node.
+func removeDriverRegistration(f *framework.Framework, nodeName, driverName string) {
+	By(fmt.Sprintf("removing the registration of driver %s on node %s", driverName, nodeName))
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := f.ClientSet.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		value, ok := node.Annotations[nodeIDAnnotation]
+		if !ok {
+			return nil
+		}
+		nodeIDs := map[string]string{}
+		if err := json.Unmarshal([]byte(value), &nodeIDs); err != nil {
+			return err
+		}
+		delete(nodeIDs, driverName)
+		if len(nodeIDs) == 0 {
+			delete(node.Annotations, nodeIDAnnotation)
+		} else {
+			data, err := json.Marshal(nodeIDs)
+			if err != nil {
+				return err
+			}
+			node.Annotations[nodeIDAnnotation] = string(data)
+		}
+		_, err = f.ClientSet.CoreV1().Nodes().Update(node)
+		return err
+	})
+	framework.ExpectNoError(err, "remove driver %s from %s annotation of node %s", driverName, nodeIDAnnotation, nodeName)
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		nodeInfo, err := f.CSIClientSet.CsiV1alpha1().CSINodeInfos().Get(nodeName, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		specs := nodeInfo.Spec.Drivers[:0]
+		for _, info := range nodeInfo.Spec.Drivers {
+			if info.Name != driverName {
+				specs = append(specs, info)
+			}
+		}
+		nodeInfo.Spec.Drivers = specs
+		statuses := nodeInfo.Status.Drivers[:0]
+		for _, info := range nodeInfo.Status.Drivers {
+			if info.Name != driverName {
+				statuses = append(statuses, info)
+			}
+		}
+		nodeInfo.Status.Drivers = statuses
+		_, err = f.CSIClientSet.CsiV1alpha1().CSINodeInfos().Update(nodeInfo)
+		return err
+	})
+	framework.ExpectNoError(err, "remove driver %s from CSINodeInfo %s", driverName, nodeName)
+
+	_, registration := getDriverRegistrations(f, nodeName, driverName)
+	Expect(registration.registered()).To(BeFalse(), "registration of driver %s on node %s after removal: %+v", driverName, nodeName, registration)
+}
+
+// waitForRegistration waits until the driver is registered correctly
+// (registered == true) or not registered at all (registered == false).
+func waitForRegistration(driver *manifestDriver, nodeName string, registered bool) {
+	f := driver.driverInfo.Config.Framework
+	driverName := driver.finalPatchOptions().NewDriverName
+	expectedNodeID := nodeName
+	if driver.nodeID != nil {
+		expectedNodeID = driver.nodeID(nodeName)
+	}
+	expectedKeys := append([]string{}, driver.topologyKeys...)
+	sort.Strings(expectedKeys)
+
+	By(fmt.Sprintf("waiting for driver %s to be registered on node %s: %v", driverName, nodeName, registered))
+	var registration driverRegistration
+	var problem string
+	err := wait.PollImmediate(framework.Poll, registrationTimeout, func() (bool, error) {
+		_, registration = getDriverRegistrations(f, nodeName, driverName)
+		if !registered {
+			return !registration.registered(), nil
+		}
+		switch {
+		case !registration.registered():
+			problem = "not registered"
+			return false, nil
+		case registration.annotationNodeID != "" && registration.annotationNodeID != expectedNodeID:
+			problem = fmt.Sprintf("node annotation has node ID %q instead of %q", registration.annotationNodeID, expectedNodeID)
+			return false, nil
+		case registration.nodeInfoNodeID != "" && registration.nodeInfoNodeID != expectedNodeID:
+			problem = fmt.Sprintf("CSINodeInfo has node ID %q instead of %q", registration.nodeInfoNodeID, expectedNodeID)
+			return false, nil
+		}
+		if registration.nodeInfoNodeID != "" {
+			keys := append([]string{}, registration.nodeInfoTopologyKeys...)
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != strings.Join(expectedKeys, ",") {
+				problem = fmt.Sprintf("CSINodeInfo has topology keys %v instead of %v", keys, expectedKeys)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		if registered {
+			framework.Failf("driver %s on node %s: %s", driverName, nodeName, problem)
+		}
+		framework.Failf("stale registration of driver %s on node %s: %+v", driverName, nodeName, registration)
+	}
+	framework.ExpectNoError(err)
+
+	if registered {
+		node, err := f.ClientSet.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		framework.ExpectNoError(err, "get node %s", nodeName)
+		for _, key := range expectedKeys {
+			Expect(node.Labels).To(HaveKey(key), "topology label of node %s", nodeName)
+		}
+	}
+}
+
+// checkStaleRegistrations fails when the node has registrations for
+// renamed drivers (i.e. "<driver name prefix><namespace>") whose test
+// namespace is already gone. Those are left over from earlier test
+// runs.
+func checkStaleRegistrations(f *framework.Framework, nodeName, driverNamePrefix string) {
+	if !strings.HasSuffix(driverNamePrefix, "-") {
+		// Driver is not renamed.
+		return
+	}
+	nodeIDs, _ := getDriverRegistrations(f, nodeName, "")
+	var stale []string
+	for driverName := range nodeIDs {
+		if !strings.HasPrefix(driverName, driverNamePrefix) {
+			continue
+		}
+		namespace := strings.TrimPrefix(driverName, driverNamePrefix)
+		_, err := f.ClientSet.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			stale = append(stale, driverName)
+			continue
+		}
+		framework.ExpectNoError(err, "get namespace %s", namespace)
+	}
+	Expect(stale).To(BeEmpty(), "stale driver registrations on node %s", nodeName)
+}
@@ -0,0 +1,482 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	"github.com/kubernetes-csi/csi-e2e/pkg/csiproxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// The name of the helper pod and its container.
+	sanityPodName = "csi-sanity"
+
+	// The capability types and access mode used by the sanity
+	// checks. The values are the same in CSI 0.3 and 1.0.
+	pluginControllerService          = 1
+	controllerCreateDeleteVolume     = 1
+	controllerPublishUnpublishVolume = 2
+	nodeStageUnstageVolume           = 1
+	accessModeSingleNodeWriter       = 1
+)
+
+// sanityClient invokes CSI calls with "csi-proxy call" inside a
+// helper pod which has the socket directory of the driver mounted.
+// The requests get encoded here because the generated Go code for
+// CSI is not available. They only use fields whose numbers are the
+// same in csi.v0 and csi.v1, which is not the case for all fields
+// (see the field tables in pkg/csiproxy). Calls bypass the fault
+// injection proxy.
+type sanityClient struct {
+	driver   *manifestDriver
+	pod      *v1.Pod
+	endpoint string
+	// service is the package of the CSI services, "csi.v0" or
+	// "csi.v1".
+	service string
+	// volumes contains the IDs of all volumes created by the
+	// checks, for cleanup.
+	volumes []string
+}
+
+// newSanityClient starts the helper pod on the node of the driver
+// plugin pod and detects the CSI version of the driver.
+func newSanityClient(driver *manifestDriver) *sanityClient {
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+	plugin := getDriverPod(driver, driver.driverPods.plugin)
+
+	socketDir := path.Dir(driver.csiSocket)
+	var socketSource *v1.HostPathVolumeSource
+	for _, container := range plugin.Spec.Containers {
+		if container.Name != driver.patchOptions.DriverContainerName {
+			continue
+		}
+		for _, mount := range container.VolumeMounts {
+			for _, volume := range plugin.Spec.Volumes {
+				if mount.MountPath == socketDir && volume.Name == mount.Name {
+					socketSource = volume.HostPath
+				}
+			}
+		}
+	}
+	if socketSource == nil {
+		framework.Failf("driver pod %s: no host path volume mounted at %s", plugin.Name, socketDir)
+	}
+
+	By(fmt.Sprintf("starting sanity helper pod on node %s", plugin.Spec.NodeName))
+	immediate := int64(0)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sanityPodName,
+			Namespace: f.Namespace.Name,
+		},
+		Spec: v1.PodSpec{
+			NodeName:                      plugin.Spec.NodeName,
+			TerminationGracePeriodSeconds: &immediate,
+			Containers: []v1.Container{
+				{
+					Name:            sanityPodName,
+					Image:           csiTestContext.proxyImage,
+					ImagePullPolicy: v1.PullIfNotPresent,
+					Command:         []string{"sh", "-c", "trap exit TERM; while true; do sleep 5; done"},
+					VolumeMounts: []v1.VolumeMount{
+						{
+							Name:      "socket-dir",
+							MountPath: socketDir,
+						},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "socket-dir",
+					VolumeSource: v1.VolumeSource{
+						HostPath: socketSource,
+					},
+				},
+			},
+		},
+	}
+	pod, err := cs.CoreV1().Pods(f.Namespace.Name).Create(pod)
+	framework.ExpectNoError(err, "create sanity helper pod")
+	err = framework.WaitForPodNameRunningInNamespace(cs, pod.Name, pod.Namespace)
+	framework.ExpectNoError(err, "sanity helper pod %s not running", pod.Name)
+
+	c := &sanityClient{
+		driver:   driver,
+		pod:      pod,
+		endpoint: "unix://" + driver.csiSocket,
+	}
+	if driver.hasCSIProxy() {
+		c.endpoint = "unix://" + path.Join(socketDir, proxyDriverSocket)
+	}
+	// GetPluginInfo exists in all CSI versions.
+	for _, service := range []string{"csi.v1", "csi.v0"} {
+		c.service = service
+		if result := c.call("Identity/GetPluginInfo", csiproxy.Message{}); result.Code != codes.Unimplemented.String() {
+			framework.Logf("driver %s implements %s", driver.driverInfo.Name, service)
+			return c
+		}
+	}
+	framework.Failf("driver %s implements neither csi.v1 nor csi.v0", driver.driverInfo.Name)
+	return nil
+}
+
+// call invokes a method like "Identity/Probe" and returns the result.
+func (c *sanityClient) call(method string, request csiproxy.Message) csiproxy.CallResult {
+	f := c.driver.driverInfo.Config.Framework
+	fullMethod := fmt.Sprintf("/%s.%s", c.service, method)
+	stdout, stderr, err := f.ExecCommandInContainerWithFullOutput(c.pod.Name, sanityPodName,
+		"/csi-proxy", "--driver-endpoint="+c.endpoint, "call", fullMethod, base64.StdEncoding.EncodeToString(request))
+	framework.ExpectNoError(err, "csi-proxy call %s: %s", fullMethod, stderr)
+	var result csiproxy.CallResult
+	err = json.Unmarshal([]byte(stdout), &result)
+	framework.ExpectNoError(err, "decode result %q", stdout)
+	framework.Logf("%s: %s %s", fullMethod, result.Code, result.Error)
+	return result
+}
+
+// mustCall checks that the call succeeds and returns the response.
+func (c *sanityClient) mustCall(method string, request csiproxy.Message) map[string]interface{} {
+	result := c.call(method, request)
+	Expect(result.Code).To(Equal(codes.OK.String()), "%s: %s", method, result.Error)
+	return result.Response
+}
+
+// expectCode checks that the call fails with the given code.
+func (c *sanityClient) expectCode(code codes.Code, method string, request csiproxy.Message) {
+	result := c.call(method, request)
+	Expect(result.Code).To(Equal(code.String()), "%s: %s", method, result.Error)
+}
+
+// shell runs a command in the helper pod.
+func (c *sanityClient) shell(command string) {
+	f := c.driver.driverInfo.Config.Framework
+	_, stderr, err := f.ExecCommandInContainerWithFullOutput(c.pod.Name, sanityPodName, "sh", "-c", command)
+	framework.ExpectNoError(err, "%s: %s", command, stderr)
+}
+
+// capabilities returns the capability types from a
+// GetPluginCapabilities, ControllerGetCapabilities or
+// NodeGetCapabilities response.
+func (c *sanityClient) capabilities(method string) map[int]bool {
+	types := map[int]bool{}
+	for _, capability := range wireRepeated(c.mustCall(method, csiproxy.Message{})["1"]) {
+		if t, ok := wireField(capability, 1, 1).(float64); ok {
+			types[int(t)] = true
+		}
+	}
+	framework.Logf("%s: %v", method, types)
+	return types
+}
+
+// skipUnlessController skips checks which need CreateVolume and
+// DeleteVolume.
+func (c *sanityClient) skipUnlessController() {
+	if !c.capabilities("Identity/GetPluginCapabilities")[pluginControllerService] ||
+		!c.capabilities("Controller/ControllerGetCapabilities")[controllerCreateDeleteVolume] {
+		framework.Skipf("Driver %s does not support CreateVolume -- skipping", c.driver.driverInfo.Name)
+	}
+}
+
+// createVolume creates a volume with the claim size of the driver and
+// returns its ID and attributes.
+func (c *sanityClient) createVolume(name string) (string, map[string]string) {
+	request := csiproxy.Message{}.String(1, name)
+	if c.driver.claimSize != "" {
+		size := resource.MustParse(c.driver.claimSize)
+		request = request.Message(2, csiproxy.Message{}.Varint(1, uint64(size.Value())))
+	}
+	request = request.Message(3, mountCapability())
+	response := c.mustCall("Controller/CreateVolume", request)
+	volumeID, _ := wireField(response, 1, 2).(string)
+	Expect(volumeID).NotTo(BeEmpty(), "volume ID in CreateVolume response %v", response)
+	c.volumes = append(c.volumes, volumeID)
+	return volumeID, wireMap(wireField(response, 1, 3))
+}
+
+// cleanup deletes all volumes, the directory for mount points and the
+// helper pod. Problems are only logged.
+func (c *sanityClient) cleanup() {
+	for _, volumeID := range c.volumes {
+		if result := c.call("Controller/DeleteVolume", csiproxy.Message{}.String(1, volumeID)); result.Code != codes.OK.String() {
+			framework.Logf("deleting volume %s failed: %s: %s", volumeID, result.Code, result.Error)
+		}
+	}
+	if c.driver.sanityMountDir != "" {
+		c.shell("rm -rf " + c.driver.sanityMountDir)
+	}
+	f := c.driver.driverInfo.Config.Framework
+	if err := f.ClientSet.CoreV1().Pods(c.pod.Namespace).Delete(c.pod.Name, metav1.NewDeleteOptions(0)); err != nil {
+		framework.Logf("deleting pod %s failed: %v", c.pod.Name, err)
+	}
+}
+
+// mountCapability returns a VolumeCapability for a mounted volume
+// with SINGLE_NODE_WRITER access mode.
+func mountCapability() csiproxy.Message {
+	return csiproxy.Message{}.
+		Message(2, csiproxy.Message{}).
+		Message(3, csiproxy.Message{}.Varint(1, accessModeSingleNodeWriter))
+}
+
+// wireField returns the value of a field in nested messages as
+// decoded by csiproxy.Invoke, nil if not set.
+func wireField(message interface{}, numbers ...int) interface{} {
+	for _, number := range numbers {
+		fields, ok := message.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		message = fields[strconv.Itoa(number)]
+	}
+	return message
+}
+
+// wireRepeated returns the values of a repeated field.
+func wireRepeated(value interface{}) []interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return value
+	default:
+		return []interface{}{value}
+	}
+}
+
+// wireMap returns the content of a map<string, string> field.
+func wireMap(field interface{}) map[string]string {
+	m := map[string]string{}
+	for _, entry := range wireRepeated(field) {
+		key, _ := wireField(entry, 1).(string)
+		value, _ := wireField(entry, 2).(string)
+		m[key] = value
+	}
+	return m
+}
+
+type sanityTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &sanityTestSuite{}
+
+// initSanityTestSuite returns sanityTestSuite that implements csiTestSuite interface
+func initSanityTestSuite() csiTestSuite {
+	return &sanityTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "sanity",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *sanityTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *sanityTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if csiTestContext.proxyImage == "" {
+		framework.Skipf("-csi.proxy-image not set -- skipping")
+	}
+	if driver.csiSocket == "" || driver.driverPods.plugin == "" {
+		framework.Skipf("Driver %s does not support sanity checks -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *sanityTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var client *sanityClient
+
+		BeforeEach(func() {
+			client = nil
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			client = newSanityClient(driver)
+		})
+
+		AfterEach(func() {
+			if client != nil {
+				client.cleanup()
+			}
+		})
+
+		// skipUnlessMountDir skips checks which need to create
+		// staging and target paths.
+		skipUnlessMountDir := func() {
+			if driver.sanityMountDir == "" {
+				framework.Skipf("Driver %s has no sanityMountDir -- skipping", driver.driverInfo.Name)
+			}
+		}
+
+		It("[Identity] should return plugin name and version", func() {
+			driverName := driver.finalPatchOptions().NewDriverName
+			if driverName == "" {
+				driverName = driver.driverInfo.Name
+			}
+			response := client.mustCall("Identity/GetPluginInfo", csiproxy.Message{})
+			Expect(response["1"]).To(Equal(driverName), "name")
+			Expect(response["2"]).NotTo(BeEmpty(), "vendor_version")
+		})
+
+		It("[Identity] should report capabilities", func() {
+			client.capabilities("Identity/GetPluginCapabilities")
+		})
+
+		It("[Identity] should be ready", func() {
+			response := client.mustCall("Identity/Probe", csiproxy.Message{})
+			// An unset "ready" field means ready, an empty one false.
+			if ready, ok := response["1"]; ok {
+				Expect(wireField(ready, 1)).To(BeEquivalentTo(1), "ready")
+			}
+		})
+
+		It("[Controller] should reject CreateVolume without name or capabilities", func() {
+			client.skipUnlessController()
+			client.expectCode(codes.InvalidArgument, "Controller/CreateVolume",
+				csiproxy.Message{}.Message(3, mountCapability()))
+			client.expectCode(codes.InvalidArgument, "Controller/CreateVolume",
+				csiproxy.Message{}.String(1, "csi-sanity-"+driver.driverInfo.Config.Framework.UniqueName))
+		})
+
+		It("[Controller] should create volumes idempotently", func() {
+			client.skipUnlessController()
+			name := "csi-sanity-" + driver.driverInfo.Config.Framework.UniqueName
+			volumeID, _ := client.createVolume(name)
+			again, _ := client.createVolume(name)
+			Expect(again).To(Equal(volumeID), "volume ID of second CreateVolume call with the same name")
+		})
+
+		It("[Controller] should delete volumes idempotently", func() {
+			client.skipUnlessController()
+			volumeID, _ := client.createVolume("csi-sanity-" + driver.driverInfo.Config.Framework.UniqueName)
+			client.mustCall("Controller/DeleteVolume", csiproxy.Message{}.String(1, volumeID))
+			client.mustCall("Controller/DeleteVolume", csiproxy.Message{}.String(1, volumeID))
+			client.mustCall("Controller/DeleteVolume", csiproxy.Message{}.String(1, "csi-sanity-no-such-volume"))
+			client.expectCode(codes.InvalidArgument, "Controller/DeleteVolume", csiproxy.Message{})
+		})
+
+		It("[Controller] should reject invalid ControllerPublishVolume calls", func() {
+			client.skipUnlessController()
+			if !client.capabilities("Controller/ControllerGetCapabilities")[controllerPublishUnpublishVolume] {
+				framework.Skipf("Driver %s does not support ControllerPublishVolume -- skipping", driver.driverInfo.Name)
+			}
+			nodeID, _ := client.mustCall("Node/NodeGetInfo", csiproxy.Message{})["1"].(string)
+			volumeID, _ := client.createVolume("csi-sanity-" + driver.driverInfo.Config.Framework.UniqueName)
+			client.expectCode(codes.InvalidArgument, "Controller/ControllerPublishVolume",
+				csiproxy.Message{}.String(2, nodeID).Message(3, mountCapability()))
+			client.expectCode(codes.InvalidArgument, "Controller/ControllerPublishVolume",
+				csiproxy.Message{}.String(1, volumeID).Message(3, mountCapability()))
+			client.expectCode(codes.NotFound, "Controller/ControllerPublishVolume",
+				csiproxy.Message{}.String(1, "csi-sanity-no-such-volume").String(2, nodeID).Message(3, mountCapability()))
+		})
+
+		It("[Node] should return capabilities and node ID", func() {
+			client.capabilities("Node/NodeGetCapabilities")
+			expected := client.pod.Spec.NodeName
+			if driver.nodeID != nil {
+				expected = driver.nodeID(expected)
+			}
+			response := client.mustCall("Node/NodeGetInfo", csiproxy.Message{})
+			Expect(response["1"]).To(Equal(expected), "node_id")
+		})
+
+		It("[Node] should reject NodePublishVolume and NodeUnpublishVolume without required fields", func() {
+			targetPath := "/csi-sanity/no-such-target"
+			client.expectCode(codes.InvalidArgument, "Node/NodePublishVolume",
+				csiproxy.Message{}.String(4, targetPath).Message(5, mountCapability()))
+			client.expectCode(codes.InvalidArgument, "Node/NodePublishVolume",
+				csiproxy.Message{}.String(1, "csi-sanity-volume").Message(5, mountCapability()))
+			client.expectCode(codes.InvalidArgument, "Node/NodePublishVolume",
+				csiproxy.Message{}.String(1, "csi-sanity-volume").String(4, targetPath))
+			client.expectCode(codes.InvalidArgument, "Node/NodeUnpublishVolume",
+				csiproxy.Message{}.String(2, targetPath))
+			client.expectCode(codes.InvalidArgument, "Node/NodeUnpublishVolume",
+				csiproxy.Message{}.String(1, "csi-sanity-volume"))
+		})
+
+		It("[Node] should publish and unpublish a volume", func() {
+			skipUnlessMountDir()
+			client.skipUnlessController()
+			publish := client.capabilities("Controller/ControllerGetCapabilities")[controllerPublishUnpublishVolume]
+			stage := client.capabilities("Node/NodeGetCapabilities")[nodeStageUnstageVolume]
+			nodeID, _ := client.mustCall("Node/NodeGetInfo", csiproxy.Message{})["1"].(string)
+			stagingPath := path.Join(driver.sanityMountDir, "staging")
+			targetPath := path.Join(driver.sanityMountDir, "target")
+			client.shell(fmt.Sprintf("mkdir -p %s %s", stagingPath, targetPath))
+
+			volumeID, attributes := client.createVolume("csi-sanity-" + driver.driverInfo.Config.Framework.UniqueName)
+			publishContext := map[string]string{}
+			if publish {
+				response := client.mustCall("Controller/ControllerPublishVolume", csiproxy.Message{}.
+					String(1, volumeID).
+					String(2, nodeID).
+					Message(3, mountCapability()).
+					Map(6, attributes))
+				publishContext = wireMap(response["1"])
+			}
+			if stage {
+				client.mustCall("Node/NodeStageVolume", csiproxy.Message{}.
+					String(1, volumeID).
+					Map(2, publishContext).
+					String(3, stagingPath).
+					Message(4, mountCapability()).
+					Map(6, attributes))
+			} else {
+				stagingPath = ""
+			}
+			publishRequest := csiproxy.Message{}.
+				String(1, volumeID).
+				Map(2, publishContext).
+				String(3, stagingPath).
+				String(4, targetPath).
+				Message(5, mountCapability()).
+				Map(8, attributes)
+			client.mustCall("Node/NodePublishVolume", publishRequest)
+			By("publishing the same volume again")
+			client.mustCall("Node/NodePublishVolume", publishRequest)
+
+			client.mustCall("Node/NodeUnpublishVolume", csiproxy.Message{}.String(1, volumeID).String(2, targetPath))
+			if stage {
+				client.mustCall("Node/NodeUnstageVolume", csiproxy.Message{}.String(1, volumeID).String(2, stagingPath))
+			}
+			if publish {
+				client.mustCall("Controller/ControllerUnpublishVolume", csiproxy.Message{}.String(1, volumeID).String(2, nodeID))
+			}
+			client.mustCall("Controller/DeleteVolume", csiproxy.Message{}.String(1, volumeID))
+		})
+	})
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/framework/testfiles"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The operations for which a secret can be passed to the driver.
+// They are part of the StorageClass parameter names.
+const (
+	provisionerSecret       = "provisioner"
+	controllerPublishSecret = "controller-publish"
+	nodeStageSecret         = "node-stage"
+	nodePublishSecret       = "node-publish"
+)
+
+// driverSecret describes a secret that gets created in the test
+// namespace together with the driver and then is referenced by the
+// driver's StorageClass.
+type driverSecret struct {
+	// The name of the secret.
+	name string
+
+	// Secret data that is read from files. The key is the key
+	// in the secret, the value the file name relative to the
+	// repo root, like the manifests.
+	files map[string]string
+
+	// Secret data that is given directly.
+	literals map[string]string
+
+	// The operations which need the secret (provisionerSecret,
+	// controllerPublishSecret, nodeStageSecret, nodePublishSecret).
+	usages []string
+
+	// The values of the "-secret-name" and "-secret-namespace"
+	// parameters. They get passed through unchanged and thus may
+	// contain templates like ${pvc.namespace}. The default is the
+	// name of the secret and the test namespace.
+	nameParameter      string
+	namespaceParameter string
+}
+
+// secretParameterNames returns the StorageClass parameters for the
+// name and namespace of the secret for the operation.
+func secretParameterNames(usage string) (string, string) {
+	prefix := "csi.storage.k8s.io/" + usage
+	return prefix + "-secret-name", prefix + "-secret-namespace"
+}
+
+// secretParameters returns the StorageClass parameters for all
+// secrets of the driver.
+func (m *manifestDriver) secretParameters() map[string]string {
+	f := m.driverInfo.Config.Framework
+	parameters := map[string]string{}
+	for _, secret := range m.secrets {
+		name := secret.nameParameter
+		if name == "" {
+			name = secret.name
+		}
+		namespace := secret.namespaceParameter
+		if namespace == "" {
+			namespace = f.Namespace.Name
+		}
+		for _, usage := range secret.usages {
+			nameKey, namespaceKey := secretParameterNames(usage)
+			parameters[nameKey] = name
+			parameters[namespaceKey] = namespace
+		}
+	}
+	return parameters
+}
+
+// createSecrets creates all secrets of the driver and returns a
+// function that deletes them again.
+func (m *manifestDriver) createSecrets() (func(), error) {
+	f := m.driverInfo.Config.Framework
+	var items []interface{}
+	for _, secret := range m.secrets {
+		data := map[string][]byte{}
+		for key, fileName := range secret.files {
+			content, err := testfiles.Read(fileName)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s: %v", secret.name, err)
+			}
+			data[key] = content
+		}
+		for key, value := range secret.literals {
+			data[key] = []byte(value)
+		}
+		items = append(items, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secret.name,
+				Namespace: f.Namespace.Name,
+			},
+			Data: data,
+		})
+	}
+	return f.CreateItems(items...)
+}
+
+type secretsTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &secretsTestSuite{}
+
+// initSecretsTestSuite returns secretsTestSuite that implements csiTestSuite interface
+func initSecretsTestSuite() csiTestSuite {
+	return &secretsTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "storage class secrets",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *secretsTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *secretsTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if len(driver.secrets) == 0 {
+		framework.Skipf("Driver %s has no secrets -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *secretsTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		// setup creates the StorageClass, optionally with
+		// modified parameters.
+		setup := func(parameters map[string]string) {
+			needsCleanup = true
+			resource.parameters = parameters
+			resource.setupResource(driver, pattern)
+		}
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+
+			resource = csiVolumeTestResource{}
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should provision and mount volumes with secrets", func() {
+			f := driver.driverInfo.Config.Framework
+			nodeName := driver.driverInfo.Config.ClientNodeName
+			setup(nil)
+
+			pvc, _ := resource.createBoundClaim("")
+			runInPodWithCSIVolume(f.ClientSet, pvc.Namespace, pvc.Name, nodeName, "echo hello > /mnt/test/data && grep -q hello /mnt/test/data")
+		})
+
+		It("should fail to provision when the provisioner secret is missing", func() {
+			secret := provisionerSecretOrSkip(driver)
+			nameKey, _ := secretParameterNames(provisionerSecret)
+			missing := secret.name + "-missing"
+			setup(map[string]string{nameKey: missing})
+
+			testSecretProvisioningFailure(driver, &resource, missing)
+		})
+
+		It("should fail to provision when the provisioner secret has the wrong namespace", func() {
+			secret := provisionerSecretOrSkip(driver)
+			_, namespaceKey := secretParameterNames(provisionerSecret)
+			setup(map[string]string{namespaceKey: metav1.NamespaceDefault})
+
+			testSecretProvisioningFailure(driver, &resource, secret.name)
+		})
+	})
+}
+
+// provisionerSecretOrSkip returns the secret of the driver which is
+// used for provisioning and skips the test if there is none.
+func provisionerSecretOrSkip(driver *manifestDriver) driverSecret {
+	for _, secret := range driver.secrets {
+		for _, usage := range secret.usages {
+			if usage == provisionerSecret {
+				if secret.nameParameter != "" {
+					framework.Skipf("Driver %s uses a templated name for the provisioner secret -- skipping", driver.driverInfo.Name)
+				}
+				return secret
+			}
+		}
+	}
+	framework.Skipf("Driver %s has no provisioner secret -- skipping", driver.driverInfo.Name)
+	return driverSecret{}
+}
+
+// testSecretProvisioningFailure creates a claim and expects
+// provisioning to fail with an event that mentions the secret.
+func testSecretProvisioningFailure(driver *manifestDriver, resource *csiVolumeTestResource, secretName string) {
+	cs := driver.driverInfo.Config.Framework.ClientSet
+
+	pvc := resource.createClaim("")
+	message := waitForClaimEvent(cs, pvc, "ProvisioningFailed", framework.ClaimProvisionTimeout)
+	Expect(message).To(ContainSubstring(secretName), "ProvisioningFailed event should mention the secret")
+}
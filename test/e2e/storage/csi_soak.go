@@ -0,0 +1,615 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	"github.com/onsi/ginkgo/types"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientset "k8s.io/client-go/kubernetes"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+	"k8s.io/kubernetes/pkg/master/ports"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+const (
+	// soakTrendTolerancePercent is how much the average of a
+	// metric in the last third of the soak iterations may be
+	// above the average in the first third before it gets
+	// reported as a regression.
+	soakTrendTolerancePercent = 25
+
+	// soakReportFile is the name of the soak report in the
+	// report directory.
+	soakReportFile = "csi-soak.json"
+)
+
+// soakIteration contains the results of one run of all selected
+// tests.
+type soakIteration struct {
+	Number  int       `json:"number"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Passed  int       `json:"passed"`
+	Failed  int       `json:"failed"`
+	Skipped int       `json:"skipped"`
+
+	// The full names of the failed tests.
+	Failures []string `json:"failures,omitempty"`
+
+	// Volumes, attachments and mounts which were left behind
+	// by the tests of this iteration.
+	Leaks []string `json:"leaks,omitempty"`
+
+	// The maximum of each resource usage sample, for example
+	// "csi-hostpath/csi-provisioner memory bytes".
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+func (i *soakIteration) ok() bool {
+	return i.Failed == 0 && len(i.Leaks) == 0
+}
+
+// soakReport is the aggregated result of a soak run.
+type soakReport struct {
+	Start       time.Time        `json:"start"`
+	End         time.Time        `json:"end"`
+	Duration    string           `json:"duration"`
+	Interrupted bool             `json:"interrupted"`
+	Iterations  []*soakIteration `json:"iterations"`
+
+	// Metrics which grew by more than soakTrendTolerancePercent
+	// over the iterations.
+	Regressions []string `json:"regressions,omitempty"`
+
+	// Tests which passed in some iterations and failed in others.
+	Flaky []string `json:"flaky,omitempty"`
+}
+
+func (r *soakReport) ok() bool {
+	for _, iteration := range r.Iterations {
+		if !iteration.ok() {
+			return false
+		}
+	}
+	return len(r.Regressions) == 0
+}
+
+// soakRun is the state of a running soak test.
+type soakRun struct {
+	mutex       sync.Mutex
+	cs          clientset.Interface
+	report      soakReport
+	current     *soakIteration
+	interrupt   chan os.Signal
+	interrupted bool
+
+	// Whether a test passed resp. failed in any iteration.
+	passed, failed sets.String
+
+	// What existed before the first iteration and thus does
+	// not count as leaked.
+	baselineVolumes     sets.String
+	baselineAttachments sets.String
+	baselineMounts      map[string]int
+}
+
+// soak is set while RunSoak runs.
+var soak *soakRun
+
+// SoakEnabled returns true if -csi.soak-duration was given.
+func SoakEnabled() bool {
+	return csiTestContext.soakDuration > 0
+}
+
+// RunSoak calls runSpecs repeatedly until -csi.soak-duration is over
+// or the process gets interrupted. runSpecs must run all selected
+// tests once and pass the additional reporters to Ginkgo. The last
+// iteration may end after the duration because iterations are never
+// cut short.
+//
+// Ginkgo registers an interrupt handler in each runSpecs call and
+// never removes it. The handlers of the previous iterations get reset
+// before each iteration, otherwise all of them would run the
+// AfterSuite and report a failed suite to their reporters. The
+// remaining handler runs the AfterSuite cleanup, which also removes
+// the driver deployments, then calls the soakReporter, which
+// completes the soak report, and exits.
+func RunSoak(t *testing.T, runSpecs func(reporters []ginkgo.Reporter) bool) {
+	if config.GinkgoConfig.ParallelTotal > 1 {
+		t.Fatalf("-csi.soak-duration does not support parallel test runs")
+	}
+	cs, err := framework.LoadClientset()
+	if err != nil {
+		t.Fatalf("loading client: %v", err)
+	}
+
+	s := &soakRun{
+		report: soakReport{
+			Start:    time.Now(),
+			Duration: csiTestContext.soakDuration.String(),
+		},
+		cs:        cs,
+		interrupt: make(chan os.Signal, 1),
+		passed:    sets.NewString(),
+		failed:    sets.NewString(),
+	}
+	soak = s
+	defer func() {
+		soak = nil
+	}()
+	defer signal.Stop(s.interrupt)
+
+	if err := s.takeBaseline(cs); err != nil {
+		t.Fatalf("checking the cluster before the soak test: %v", err)
+	}
+	deadline := s.report.Start.Add(csiTestContext.soakDuration)
+	for number := 1; !s.isInterrupted() && (number == 1 || time.Now().Before(deadline)); number++ {
+		fmt.Printf("\nSoak iteration %d, %s left\n", number, deadline.Sub(time.Now()).Round(time.Second))
+		iteration := s.startIteration(number)
+		// Leaves only the handler which Ginkgo registers in
+		// this runSpecs call. s.interrupt merely tells the
+		// soakReporter why the suite ended.
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		signal.Notify(s.interrupt, os.Interrupt, syscall.SIGTERM)
+		runSpecs([]ginkgo.Reporter{&soakReporter{run: s, iteration: iteration}})
+	}
+	s.finish()
+	if !s.report.ok() {
+		t.Errorf("soak test failed, see the soak summary")
+	}
+}
+
+// isInterrupted checks whether SIGINT or SIGTERM was received. The
+// signal reaches the channel together with the interrupt handler of
+// Ginkgo, which then first runs the AfterSuite before calling the
+// soakReporter.
+func (s *soakRun) isInterrupted() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.interrupt:
+		s.interrupted = true
+		s.report.Interrupted = true
+	default:
+	}
+	return s.interrupted
+}
+
+func (s *soakRun) startIteration(number int) *soakIteration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	iteration := &soakIteration{
+		Number:  number,
+		Start:   time.Now(),
+		Metrics: map[string]float64{},
+	}
+	s.report.Iterations = append(s.report.Iterations, iteration)
+	s.current = iteration
+	return iteration
+}
+
+// endIteration checks for leaks, samples the nodes and writes the
+// report.
+func (s *soakRun) endIteration(iteration *soakIteration) {
+	leaks, err := s.findLeaks(s.cs)
+	if err != nil {
+		leaks = append(leaks, fmt.Sprintf("leak check failed: %v", err))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	iteration.End = time.Now()
+	iteration.Leaks = leaks
+	iteration.Metrics["iteration seconds"] = iteration.End.Sub(iteration.Start).Seconds()
+	s.current = nil
+	s.writeReportLocked()
+}
+
+// sample records a resource usage value for the current iteration.
+func (s *soakRun) sample(metric string, value float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.current == nil {
+		return
+	}
+	if old, ok := s.current.Metrics[metric]; !ok || value > old {
+		s.current.Metrics[metric] = value
+	}
+}
+
+// recordSpec counts the result of a test in the iteration.
+func (s *soakRun) recordSpec(iteration *soakIteration, summary *types.SpecSummary) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// The first component is the top-level container of Ginkgo.
+	name := strings.Join(summary.ComponentTexts[1:], " ")
+	switch {
+	case summary.State == types.SpecStatePassed:
+		iteration.Passed++
+		s.passed.Insert(name)
+	case summary.HasFailureState():
+		iteration.Failed++
+		iteration.Failures = append(iteration.Failures, name)
+		s.failed.Insert(name)
+	default:
+		iteration.Skipped++
+	}
+}
+
+// soakReporter records the test results of one soak iteration.
+type soakReporter struct {
+	run       *soakRun
+	iteration *soakIteration
+}
+
+var _ ginkgo.Reporter = &soakReporter{}
+
+func (r *soakReporter) SpecSuiteWillBegin(config config.GinkgoConfigType, summary *types.SuiteSummary) {
+}
+
+func (r *soakReporter) BeforeSuiteDidRun(setupSummary *types.SetupSummary) {
+}
+
+func (r *soakReporter) SpecWillRun(specSummary *types.SpecSummary) {
+}
+
+func (r *soakReporter) SpecDidComplete(specSummary *types.SpecSummary) {
+	r.run.recordSpec(r.iteration, specSummary)
+}
+
+func (r *soakReporter) AfterSuiteDidRun(setupSummary *types.SetupSummary) {
+}
+
+// SpecSuiteDidEnd gets called after the AfterSuite, also when Ginkgo
+// was interrupted. Ginkgo exits right afterwards in that case, so the
+// incomplete iteration is left as it is and the soak report gets
+// completed here.
+func (r *soakReporter) SpecSuiteDidEnd(summary *types.SuiteSummary) {
+	if r.run.isInterrupted() {
+		r.run.finish()
+		return
+	}
+	r.run.endIteration(r.iteration)
+}
+
+// takeBaseline records the volumes, attachments and mounts which
+// exist before the first iteration.
+func (s *soakRun) takeBaseline(cs clientset.Interface) error {
+	var err error
+	if s.baselineVolumes, s.baselineAttachments, err = listCSIVolumes(cs); err != nil {
+		return err
+	}
+	s.baselineMounts = map[string]int{}
+	return forEachNode(cs, "csi-soak", func(f *framework.Framework, nodeName string) error {
+		mounts, _, err := sampleNode(f, nodeName)
+		s.baselineMounts[nodeName] = mounts
+		return err
+	})
+}
+
+// findLeaks compares volumes, attachments and mounts against the
+// baseline and records the usage of the kubelet plugin directory.
+func (s *soakRun) findLeaks(cs clientset.Interface) ([]string, error) {
+	var leaks []string
+	volumes, attachments, err := listCSIVolumes(cs)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range volumes.Difference(s.baselineVolumes).List() {
+		leaks = append(leaks, "PV "+name)
+	}
+	for _, name := range attachments.Difference(s.baselineAttachments).List() {
+		leaks = append(leaks, "VolumeAttachment "+name)
+	}
+	err = forEachNode(cs, "csi-soak", func(f *framework.Framework, nodeName string) error {
+		mounts, pluginsKiB, err := sampleNode(f, nodeName)
+		if err != nil {
+			return err
+		}
+		if mounts > s.baselineMounts[nodeName] {
+			leaks = append(leaks, fmt.Sprintf("node %s: %d CSI mounts, %d before the first iteration", nodeName, mounts, s.baselineMounts[nodeName]))
+		}
+		s.sample("node "+nodeName+" plugins KiB", float64(pluginsKiB))
+		return nil
+	})
+	return leaks, err
+}
+
+// listCSIVolumes returns the names of all CSI PVs and of all
+// VolumeAttachments.
+func listCSIVolumes(cs clientset.Interface) (volumes, attachments sets.String, err error) {
+	pvs, err := cs.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	volumes = sets.NewString()
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil {
+			volumes.Insert(pv.Name)
+		}
+	}
+	vas, err := cs.StorageV1beta1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	attachments = sets.NewString()
+	for _, va := range vas.Items {
+		attachments.Insert(va.Name)
+	}
+	return volumes, attachments, nil
+}
+
+// forEachNode calls check for each schedulable node with a framework
+// whose namespace gets deleted afterwards, also when the process gets
+// interrupted. It is meant for checks outside of a test.
+func forEachNode(cs clientset.Interface, baseName string, check func(f *framework.Framework, nodeName string) error) error {
+	nodes, err := cs.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	ns, err := framework.CreateTestingNS(baseName, cs, nil)
+	if err != nil {
+		return err
+	}
+	deleteNamespace := func() {
+		if err := cs.CoreV1().Namespaces().Delete(ns.Name, nil); err != nil {
+			framework.Logf("deleting namespace %s failed: %v", ns.Name, err)
+		}
+	}
+	handle := framework.AddCleanupAction(deleteNamespace)
+	defer func() {
+		framework.RemoveCleanupAction(handle)
+		deleteNamespace()
+		if err := framework.WaitForNamespacesDeleted(cs, []string{ns.Name}, framework.NamespaceCleanupTimeout); err != nil {
+			framework.Logf("namespace %s not deleted: %v", ns.Name, err)
+		}
+	}()
+
+	f := &framework.Framework{
+		BaseName:  baseName,
+		ClientSet: cs,
+		Namespace: ns,
+	}
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		if err := check(f, node.Name); err != nil {
+			return fmt.Errorf("node %s: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// sampleNode returns the number of CSI mounts on the node and the
+// disk usage of the kubelet plugin directory.
+func sampleNode(f *framework.Framework, nodeName string) (mounts int, pluginsKiB int64, err error) {
+	stdout, stderr, err := execOnNode(f, nodeName,
+		"grep -c kubernetes.io~csi /proc/mounts; du -sk /var/lib/kubelet/plugins 2>/dev/null | cut -f1")
+	// grep fails when there are no mounts, but still prints 0.
+	lines := strings.Fields(stdout)
+	if len(lines) != 2 {
+		return 0, 0, fmt.Errorf("unexpected output %q, stderr %q, error %v", stdout, stderr, err)
+	}
+	if mounts, err = strconv.Atoi(lines[0]); err != nil {
+		return 0, 0, err
+	}
+	if pluginsKiB, err = strconv.ParseInt(lines[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	return mounts, pluginsKiB, nil
+}
+
+// recordSoakSamples records the memory and CPU usage of the driver
+// containers while soaking. It gets called before the driver is
+// removed.
+func recordSoakSamples(m *manifestDriver) {
+	if soak == nil {
+		return
+	}
+	f := m.driverInfo.Config.Framework
+	cs := f.ClientSet
+	apps := sets.NewString(m.driverPods.provisioner, m.driverPods.attacher, m.driverPods.plugin)
+	apps.Delete("")
+	pods, err := cs.CoreV1().Pods(f.Namespace.Name).List(metav1.ListOptions{})
+	if err != nil {
+		framework.Logf("listing driver pods failed: %v", err)
+		return
+	}
+	summaries := map[string]*stats.Summary{}
+	for _, pod := range pods.Items {
+		if !apps.Has(pod.Labels["app"]) || pod.Spec.NodeName == "" {
+			continue
+		}
+		summary, ok := summaries[pod.Spec.NodeName]
+		if !ok {
+			summary, err = getKubeletStats(cs, pod.Spec.NodeName)
+			if err != nil {
+				framework.Logf("getting kubelet stats of node %s failed: %v", pod.Spec.NodeName, err)
+				continue
+			}
+			summaries[pod.Spec.NodeName] = summary
+		}
+		recordPodSamples(m.driverInfo.Name, &pod, summary)
+	}
+}
+
+func recordPodSamples(driverName string, pod *v1.Pod, summary *stats.Summary) {
+	for _, podStats := range summary.Pods {
+		if podStats.PodRef.Namespace != pod.Namespace || podStats.PodRef.Name != pod.Name {
+			continue
+		}
+		for _, container := range podStats.Containers {
+			prefix := driverName + "/" + container.Name
+			if container.Memory != nil && container.Memory.WorkingSetBytes != nil {
+				soak.sample(prefix+" memory bytes", float64(*container.Memory.WorkingSetBytes))
+			}
+			if container.CPU != nil && container.CPU.UsageNanoCores != nil {
+				soak.sample(prefix+" CPU millicores", float64(*container.CPU.UsageNanoCores)/1e6)
+			}
+		}
+	}
+}
+
+// getKubeletStats retrieves the stats summary of a node from kubelet.
+func getKubeletStats(cs clientset.Interface, nodeName string) (*stats.Summary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), framework.SingleCallTimeout)
+	defer cancel()
+	data, err := cs.CoreV1().RESTClient().Get().
+		Context(ctx).
+		Resource("nodes").
+		SubResource("proxy").
+		Name(fmt.Sprintf("%s:%d", nodeName, ports.KubeletPort)).
+		Suffix("stats/summary").
+		Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	summary := &stats.Summary{}
+	if err := json.Unmarshal(data, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// findRegressions compares the average of each metric in the first
+// and the last third of the iterations. Metrics which are missing in
+// some of those iterations are ignored.
+func findRegressions(iterations []*soakIteration) []string {
+	third := len(iterations) / 3
+	if third == 0 {
+		return nil
+	}
+	average := func(iterations []*soakIteration, metric string) (float64, bool) {
+		sum := 0.0
+		for _, iteration := range iterations {
+			value, ok := iteration.Metrics[metric]
+			if !ok {
+				return 0, false
+			}
+			sum += value
+		}
+		return sum / float64(len(iterations)), true
+	}
+
+	var metrics []string
+	for metric := range iterations[0].Metrics {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	var regressions []string
+	for _, metric := range metrics {
+		first, ok := average(iterations[:third], metric)
+		if !ok || first <= 0 {
+			continue
+		}
+		last, ok := average(iterations[len(iterations)-third:], metric)
+		if !ok {
+			continue
+		}
+		if last > first*(100+soakTrendTolerancePercent)/100 {
+			regressions = append(regressions, fmt.Sprintf("%s: %.1f on average in the first %d iterations, %.1f in the last %d",
+				metric, first, third, last, third))
+		}
+	}
+	return regressions
+}
+
+// finish completes the report, writes it and prints a summary.
+func (s *soakRun) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.report.End = time.Now()
+	var completed []*soakIteration
+	for _, iteration := range s.report.Iterations {
+		if !iteration.End.IsZero() {
+			completed = append(completed, iteration)
+		}
+	}
+	s.report.Regressions = findRegressions(completed)
+	s.report.Flaky = s.passed.Intersection(s.failed).List()
+	s.writeReportLocked()
+
+	fmt.Printf("\nSoak summary: %d iterations in %s", len(s.report.Iterations), s.report.End.Sub(s.report.Start).Round(time.Second))
+	if s.report.Interrupted {
+		fmt.Printf(", interrupted")
+	}
+	fmt.Printf("\n")
+	for _, iteration := range s.report.Iterations {
+		status := "PASS"
+		if !iteration.ok() {
+			status = "FAIL"
+		}
+		if iteration.End.IsZero() {
+			status = "INCOMPLETE"
+		}
+		fmt.Printf("  iteration %d: %s, %d passed, %d failed, %d skipped, %d leaks\n",
+			iteration.Number, status, iteration.Passed, iteration.Failed, iteration.Skipped, len(iteration.Leaks))
+		for _, failure := range iteration.Failures {
+			fmt.Printf("    failed: %s\n", failure)
+		}
+		for _, leak := range iteration.Leaks {
+			fmt.Printf("    leaked: %s\n", leak)
+		}
+	}
+	for _, regression := range s.report.Regressions {
+		fmt.Printf("  regression: %s\n", regression)
+	}
+	for _, name := range s.report.Flaky {
+		fmt.Printf("  flaky: %s\n", name)
+	}
+}
+
+// writeReportLocked writes the report as JSON into the report
+// directory, if there is one.
+func (s *soakRun) writeReportLocked() {
+	if framework.TestContext.ReportDir == "" {
+		return
+	}
+	data, err := json.MarshalIndent(&s.report, "", "  ")
+	if err != nil {
+		framework.Logf("encoding soak report failed: %v", err)
+		return
+	}
+	if err := os.MkdirAll(framework.TestContext.ReportDir, 0755); err != nil {
+		framework.Logf("creating %s failed: %v", framework.TestContext.ReportDir, err)
+		return
+	}
+	fileName := path.Join(framework.TestContext.ReportDir, soakReportFile)
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		framework.Logf("writing soak report failed: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindRegressions(t *testing.T) {
+	tests := map[string]struct {
+		// Metrics of consecutive iterations.
+		metrics     []map[string]float64
+		regressions []string
+	}{
+		"too few iterations": {
+			metrics: []map[string]float64{{"pods": 1}, {"pods": 100}},
+		},
+		"stable": {
+			metrics: []map[string]float64{{"pods": 10}, {"pods": 11}, {"pods": 10}},
+		},
+		"within tolerance": {
+			metrics: []map[string]float64{{"pods": 10}, {"pods": 20}, {"pods": 12.5}},
+		},
+		"growth": {
+			metrics: []map[string]float64{{"pods": 10}, {"pods": 10}, {"pods": 13}},
+			regressions: []string{
+				"pods: 10.0 on average in the first 1 iterations, 13.0 in the last 1",
+			},
+		},
+		"averages": {
+			metrics: []map[string]float64{
+				{"mounts": 2, "pods": 10},
+				{"mounts": 4, "pods": 10},
+				{"mounts": 0, "pods": 0},
+				{"mounts": 5, "pods": 10},
+				{"mounts": 5, "pods": 10},
+				{"mounts": 5, "pods": 11},
+			},
+			regressions: []string{
+				"mounts: 3.0 on average in the first 2 iterations, 5.0 in the last 2",
+			},
+		},
+		"missing metric": {
+			metrics: []map[string]float64{{"mounts": 1, "pods": 10}, {"pods": 10}, {"pods": 10}},
+		},
+		"zero": {
+			metrics: []map[string]float64{{"mounts": 0}, {"mounts": 0}, {"mounts": 3}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var iterations []*soakIteration
+			for i, metrics := range test.metrics {
+				iterations = append(iterations, &soakIteration{Number: i + 1, Metrics: metrics})
+			}
+			regressions := findRegressions(iterations)
+			if !reflect.DeepEqual(regressions, test.regressions) {
+				t.Errorf("expected regressions %q, got: %q", test.regressions, regressions)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+	testutils "k8s.io/kubernetes/test/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// The number of replicas in the StatefulSet tests.
+	statefulSetReplicas = 3
+
+	// The name of the volume claim template and the mount path
+	// of its volume.
+	statefulSetVolume    = "data"
+	statefulSetMountPath = "/data"
+)
+
+type statefulSetTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &statefulSetTestSuite{}
+
+// initStatefulSetTestSuite returns statefulSetTestSuite that implements csiTestSuite interface
+func initStatefulSetTestSuite() csiTestSuite {
+	return &statefulSetTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "statefulset",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *statefulSetTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *statefulSetTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+}
+
+func (t *statefulSetTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				f := driver.driverInfo.Config.Framework
+				// Scales down and deletes the StatefulSets,
+				// then deletes their claims and waits for the
+				// volumes to be gone.
+				framework.DeleteAllStatefulSets(f.ClientSet, f.Namespace.Name)
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		// createStatefulSet creates a StatefulSet whose replicas
+		// run on the node and get their volumes from the
+		// driver's StorageClass, then waits for all replicas.
+		createStatefulSet := func(nodeName string) *appsv1.StatefulSet {
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			name := "csi-ss"
+			labels := map[string]string{"app": name}
+
+			By(fmt.Sprintf("creating StatefulSet %s with %d replicas", name, statefulSetReplicas))
+			_, err := cs.CoreV1().Services(f.Namespace.Name).Create(framework.CreateStatefulSetService(name, labels))
+			framework.ExpectNoError(err, "create service %s", name)
+			ss := framework.NewStatefulSet(name, f.Namespace.Name, name, statefulSetReplicas,
+				[]v1.VolumeMount{{Name: statefulSetVolume, MountPath: statefulSetMountPath}}, nil, labels)
+			ss.Spec.Template.Spec.NodeSelector = map[string]string{"kubernetes.io/hostname": nodeName}
+			template := getCSIClaim(driver.GetClaimSize(), f.Namespace.Name, resource.sc.Name)
+			ss.Spec.VolumeClaimTemplates[0].Spec = template.Spec
+			ss, err = cs.AppsV1().StatefulSets(f.Namespace.Name).Create(ss)
+			framework.ExpectNoError(err, "create StatefulSet %s", name)
+			framework.NewStatefulSetTester(cs).WaitForRunningAndReady(statefulSetReplicas, ss)
+			return ss
+		}
+
+		// getPods returns the replicas, ordered by their ordinal.
+		getPods := func(ss *appsv1.StatefulSet) []v1.Pod {
+			sst := framework.NewStatefulSetTester(driver.driverInfo.Config.Framework.ClientSet)
+			pods := sst.GetPodList(ss)
+			sst.SortStatefulPods(pods)
+			return pods.Items
+		}
+
+		// checkClaims verifies that each replica uses the claim
+		// named after the template and the replica and returns
+		// the PV name of each claim.
+		checkClaims := func(ss *appsv1.StatefulSet) map[string]string {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			volumes := map[string]string{}
+			for i := 0; i < statefulSetReplicas; i++ {
+				podName := fmt.Sprintf("%s-%d", ss.Name, i)
+				claimName := fmt.Sprintf("%s-%s", statefulSetVolume, podName)
+				pod, err := cs.CoreV1().Pods(ss.Namespace).Get(podName, metav1.GetOptions{})
+				framework.ExpectNoError(err, "get replica %s", podName)
+				var used string
+				for _, volume := range pod.Spec.Volumes {
+					if volume.Name == statefulSetVolume && volume.PersistentVolumeClaim != nil {
+						used = volume.PersistentVolumeClaim.ClaimName
+					}
+				}
+				Expect(used).To(Equal(claimName), "claim of replica %s", podName)
+				pvc, err := cs.CoreV1().PersistentVolumeClaims(ss.Namespace).Get(claimName, metav1.GetOptions{})
+				framework.ExpectNoError(err, "get claim %s", claimName)
+				Expect(pvc.Status.Phase).To(Equal(v1.ClaimBound), "phase of claim %s", claimName)
+				volumes[claimName] = pvc.Spec.VolumeName
+			}
+			Expect(len(volumes)).To(Equal(statefulSetReplicas), "claims")
+			return volumes
+		}
+
+		// checkCreationOrder verifies that the replicas were
+		// created in the order of their ordinals.
+		checkCreationOrder := func(ss *appsv1.StatefulSet) {
+			pods := getPods(ss)
+			for i := 1; i < len(pods); i++ {
+				Expect(pods[i].CreationTimestamp.Before(&pods[i-1].CreationTimestamp)).To(BeFalse(),
+					"replica %s created before %s", pods[i].Name, pods[i-1].Name)
+			}
+		}
+
+		// writeIdentities writes the name of each replica into
+		// its volume.
+		writeIdentities := func(ss *appsv1.StatefulSet) {
+			f := driver.driverInfo.Config.Framework
+			By("writing the identity of each replica")
+			for _, pod := range getPods(ss) {
+				_, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, pod.Spec.Containers[0].Name,
+					"sh", "-c", fmt.Sprintf("echo %s > %s/identity", pod.Name, statefulSetMountPath))
+				framework.ExpectNoError(err, "write identity of %s: %s", pod.Name, stderr)
+			}
+		}
+
+		// checkIdentities verifies that each replica finds its
+		// own identity in its volume.
+		checkIdentities := func(ss *appsv1.StatefulSet) {
+			f := driver.driverInfo.Config.Framework
+			By("checking the identity of each replica")
+			pods := getPods(ss)
+			Expect(len(pods)).To(Equal(statefulSetReplicas), "replicas")
+			for _, pod := range pods {
+				identity, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, pod.Spec.Containers[0].Name,
+					"cat", statefulSetMountPath+"/identity")
+				framework.ExpectNoError(err, "read identity of %s: %s", pod.Name, stderr)
+				Expect(identity).To(Equal(pod.Name), "identity in volume of %s", pod.Name)
+			}
+		}
+
+		// waitForReplicas waits until all replicas run on the node
+		// and are ready.
+		waitForReplicas := func(ss *appsv1.StatefulSet, nodeName string) {
+			By(fmt.Sprintf("waiting for %d ready replicas on node %s", statefulSetReplicas, nodeName))
+			err := wait.PollImmediate(framework.StatefulSetPoll, framework.StatefulSetTimeout, func() (bool, error) {
+				pods := getPods(ss)
+				if len(pods) != statefulSetReplicas {
+					return false, nil
+				}
+				for i := range pods {
+					if pods[i].Spec.NodeName != nodeName {
+						return false, nil
+					}
+					if ready, _ := testutils.PodRunningReady(&pods[i]); !ready {
+						return false, nil
+					}
+				}
+				return true, nil
+			})
+			framework.ExpectNoError(err, "replicas of %s", ss.Name)
+		}
+
+		It("should give each replica its own volume and keep it when scaling to zero and back", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodeName := getClientNodes(driver, 1)[0]
+			sst := framework.NewStatefulSetTester(cs)
+
+			ss := createStatefulSet(nodeName)
+			checkCreationOrder(ss)
+			volumes := checkClaims(ss)
+			writeIdentities(ss)
+
+			By("scaling to zero replicas")
+			ss, err := sst.Scale(ss, 0)
+			framework.ExpectNoError(err)
+			sst.WaitForStatusReplicas(ss, 0)
+
+			By(fmt.Sprintf("scaling back to %d replicas", statefulSetReplicas))
+			ss, err = sst.Scale(ss, statefulSetReplicas)
+			framework.ExpectNoError(err)
+			sst.WaitForRunningAndReady(statefulSetReplicas, ss)
+			checkCreationOrder(ss)
+			Expect(checkClaims(ss)).To(Equal(volumes), "volumes of the claims after scaling")
+			checkIdentities(ss)
+		})
+
+		It("should keep the volumes of replicas which get deleted one after the other", func() {
+			cs := driver.driverInfo.Config.Framework.ClientSet
+			nodeName := getClientNodes(driver, 1)[0]
+			sst := framework.NewStatefulSetTester(cs)
+
+			ss := createStatefulSet(nodeName)
+			volumes := checkClaims(ss)
+			writeIdentities(ss)
+
+			for i, pod := range getPods(ss) {
+				By(fmt.Sprintf("deleting replica %s", pod.Name))
+				oldUID := pod.UID
+				sst.DeleteStatefulPodAtIndex(i, ss)
+				err := wait.PollImmediate(framework.Poll, framework.StatefulPodTimeout, func() (bool, error) {
+					replica, err := cs.CoreV1().Pods(ss.Namespace).Get(pod.Name, metav1.GetOptions{})
+					if err != nil {
+						return false, nil
+					}
+					return replica.UID != oldUID, nil
+				})
+				framework.ExpectNoError(err, "replica %s not recreated", pod.Name)
+				waitForReplicas(ss, nodeName)
+				checkIdentities(ss)
+			}
+			Expect(checkClaims(ss)).To(Equal(volumes), "volumes of the claims after deleting replicas")
+		})
+
+		It("should reattach volumes when replicas move to another node", func() {
+			nodes := getClientNodes(driver, 2)
+			if len(nodes) < 2 {
+				framework.Skipf("Driver %s can only be used on one node -- skipping", driver.driverInfo.Name)
+			}
+			cs := driver.driverInfo.Config.Framework.ClientSet
+
+			ss := createStatefulSet(nodes[0])
+			volumes := checkClaims(ss)
+			writeIdentities(ss)
+
+			By(fmt.Sprintf("moving the replicas to node %s", nodes[1]))
+			ss, err := framework.UpdateStatefulSetWithRetries(cs, ss.Namespace, ss.Name, func(update *appsv1.StatefulSet) {
+				update.Spec.Template.Spec.NodeSelector = map[string]string{"kubernetes.io/hostname": nodes[1]}
+			})
+			framework.ExpectNoError(err, "update StatefulSet %s", ss.Name)
+			waitForReplicas(ss, nodes[1])
+			Expect(checkClaims(ss)).To(Equal(volumes), "volumes of the claims after moving")
+			checkIdentities(ss)
+		})
+	})
+}
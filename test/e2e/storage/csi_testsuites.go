@@ -0,0 +1,531 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+	testutils "k8s.io/kubernetes/test/utils"
+	imageutils "k8s.io/kubernetes/test/utils/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// csiTestSuite is the counterpart of testsuites.TestSuite for the
+// test suites defined in this package. Those suites test behavior
+// that is specific to CSI drivers and therefore need access to the
+// manifestDriver instead of just the generic testdriver.TestDriver
+// interface. testsuites.TestSuite itself cannot be implemented
+// outside of the testsuites package.
+type csiTestSuite interface {
+	// getTestSuiteInfo returns the csiTestSuiteInfo for this csiTestSuite
+	getTestSuiteInfo() csiTestSuiteInfo
+	// skipUnsupportedTest skips the test if this csiTestSuite is not suitable to be tested with the combination of TestPattern and driver
+	skipUnsupportedTest(testpatterns.TestPattern, *manifestDriver)
+	// execTest executes test of the testpattern for the driver
+	execTest(*manifestDriver, testpatterns.TestPattern)
+}
+
+// csiTestSuiteInfo represents a set of parameters for csiTestSuite
+type csiTestSuiteInfo struct {
+	name         string                     // name of the csiTestSuite
+	featureTag   string                     // featureTag for the csiTestSuite
+	testPatterns []testpatterns.TestPattern // Slice of TestPattern for the csiTestSuite
+}
+
+// getCSITestNameStr returns the same kind of test name as
+// the testsuites package, so test output and focus expressions
+// look the same for both kinds of test suites.
+func getCSITestNameStr(suite csiTestSuite, pattern testpatterns.TestPattern) string {
+	tsInfo := suite.getTestSuiteInfo()
+	return fmt.Sprintf("[Testpattern: %s]%s %s%s", pattern.Name, pattern.FeatureTag, tsInfo.name, tsInfo.featureTag)
+}
+
+// runCSITestSuites runs all testpatterns of all csiTestSuites for a driver
+func runCSITestSuites(driver *manifestDriver, tsInits []func() csiTestSuite, tunePatternFunc func([]testpatterns.TestPattern) []testpatterns.TestPattern) {
+	for _, testSuiteInit := range tsInits {
+		suite := testSuiteInit()
+		patterns := tunePatternFunc(suite.getTestSuiteInfo().testPatterns)
+
+		for _, pattern := range patterns {
+			suite.execTest(driver, pattern)
+		}
+	}
+}
+
+// skipUnsupportedCSITest does the same checks as the skipUnsupportedTest
+// function in the testsuites package, except for the volume type: all
+// manifestDrivers support dynamic provisioning and nothing else.
+func skipUnsupportedCSITest(suite csiTestSuite, driver *manifestDriver, pattern testpatterns.TestPattern) {
+	dInfo := driver.GetDriverInfo()
+
+	if pattern.VolType != testpatterns.DynamicPV {
+		framework.Skipf("Driver %s doesn't support %v -- skipping", dInfo.Name, pattern.VolType)
+	}
+	if !dInfo.SupportedFsType.Has(pattern.FsType) {
+		framework.Skipf("Driver %s doesn't support %v -- skipping", dInfo.Name, pattern.FsType)
+	}
+	if pattern.VolMode == v1.PersistentVolumeBlock && !dInfo.IsBlockSupported {
+		framework.Skipf("Driver %s doesn't support %v -- skipping", dInfo.Name, pattern.VolMode)
+	}
+	driver.SkipUnsupportedTest(pattern)
+	suite.skipUnsupportedTest(pattern, driver)
+}
+
+// csiVolumeTestResource is a simpler version of the
+// genericVolumeTestResource from the testsuites package. It creates
+// the driver's StorageClass and then allows the test to create as
+// many claims for it as needed. All of them get deleted again
+// in cleanupResource.
+type csiVolumeTestResource struct {
+	driver *manifestDriver
+	sc     *storagev1.StorageClass
+	pvcs   []*v1.PersistentVolumeClaim
+	pvs    []*v1.PersistentVolume
+
+	// If non-empty, overrides the reclaim policy of the driver's
+	// StorageClass.
+	reclaimPolicy v1.PersistentVolumeReclaimPolicy
+
+	// Parameters which get added to or replace the parameters
+	// of the driver's StorageClass.
+	parameters map[string]string
+}
+
+// setupResource creates the StorageClass for the driver and testpattern.
+func (r *csiVolumeTestResource) setupResource(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	r.driver = driver
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+
+	r.sc = driver.GetDynamicProvisionStorageClass(pattern.FsType)
+	if r.reclaimPolicy != "" {
+		r.sc.ReclaimPolicy = &r.reclaimPolicy
+	}
+	for key, value := range r.parameters {
+		if r.sc.Parameters == nil {
+			r.sc.Parameters = map[string]string{}
+		}
+		r.sc.Parameters[key] = value
+	}
+	By("creating a StorageClass " + r.sc.Name)
+	var err error
+	r.sc, err = cs.StorageV1().StorageClasses().Create(r.sc)
+	Expect(err).NotTo(HaveOccurred())
+}
+
+// createClaim creates a claim with the given size (the default claim
+// size of the driver if empty) and access modes (ReadWriteOnce if empty)
+// for the StorageClass. It does not wait for the claim to be bound.
+func (r *csiVolumeTestResource) createClaim(claimSize string, accessModes ...v1.PersistentVolumeAccessMode) *v1.PersistentVolumeClaim {
+	f := r.driver.driverInfo.Config.Framework
+	if claimSize == "" {
+		claimSize = r.driver.GetClaimSize()
+	}
+
+	By("creating a claim")
+	pvc := getCSIClaim(claimSize, f.Namespace.Name, r.sc.Name, accessModes...)
+	pvc, err := f.ClientSet.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(pvc)
+	Expect(err).NotTo(HaveOccurred())
+	r.pvcs = append(r.pvcs, pvc)
+	return pvc
+}
+
+// createBoundClaim creates a claim like createClaim and then waits
+// for it to be bound. It returns the updated claim and its volume.
+func (r *csiVolumeTestResource) createBoundClaim(claimSize string, accessModes ...v1.PersistentVolumeAccessMode) (*v1.PersistentVolumeClaim, *v1.PersistentVolume) {
+	pvc := r.createClaim(claimSize, accessModes...)
+	return r.waitForBoundClaim(pvc)
+}
+
+// waitForBoundClaim waits for a claim created by createClaim to be
+// bound. It returns the updated claim and its volume.
+func (r *csiVolumeTestResource) waitForBoundClaim(pvc *v1.PersistentVolumeClaim) (*v1.PersistentVolumeClaim, *v1.PersistentVolume) {
+	cs := r.driver.driverInfo.Config.Framework.ClientSet
+
+	err := framework.WaitForPersistentVolumeClaimPhase(v1.ClaimBound, cs, pvc.Namespace, pvc.Name, framework.Poll, framework.ClaimProvisionTimeout)
+	Expect(err).NotTo(HaveOccurred())
+	pvc, err = cs.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(pvc.Name, metav1.GetOptions{})
+	Expect(err).NotTo(HaveOccurred())
+	pv, err := cs.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	Expect(err).NotTo(HaveOccurred())
+	r.pvs = append(r.pvs, pv)
+	return pvc, pv
+}
+
+// cleanupResource deletes all claims, waits for the dynamically
+// provisioned volumes to be removed and then deletes the StorageClass.
+// Volumes with reclaim policy Retain get switched to Delete once they
+// are released, so that the provisioner also removes them from the
+// storage backend.
+func (r *csiVolumeTestResource) cleanupResource(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	f := driver.driverInfo.Config.Framework
+	cs := f.ClientSet
+
+	// Deleting the claims destroys the state that explains a
+	// failure.
+	saveDiagnostics(driver)
+
+	for _, claim := range r.pvcs {
+		By("Deleting pvc " + claim.Name)
+		pvc, err := cs.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(claim.Name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			continue
+		}
+		framework.ExpectNoError(err, "Failed to get PVC %v", claim.Name)
+		err = framework.DeletePersistentVolumeClaim(cs, pvc.Name, pvc.Namespace)
+		framework.ExpectNoError(err, "Failed to delete PVC %v", pvc.Name)
+	}
+	r.pvcs = nil
+
+	for _, volume := range r.pvs {
+		pv, err := cs.CoreV1().PersistentVolumes().Get(volume.Name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			continue
+		}
+		framework.ExpectNoError(err, "Failed to get PV %v", volume.Name)
+		if pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain {
+			By("Deleting retained pv " + pv.Name)
+			err = framework.WaitForPersistentVolumePhase(v1.VolumeReleased, cs, pv.Name, framework.Poll, framework.PVReclaimingTimeout)
+			framework.ExpectNoError(err, "Persistent Volume %v not released", pv.Name)
+			_, err = cs.CoreV1().PersistentVolumes().Patch(pv.Name, types.StrategicMergePatchType,
+				[]byte(fmt.Sprintf(`{"spec":{"persistentVolumeReclaimPolicy":%q}}`, v1.PersistentVolumeReclaimDelete)))
+			framework.ExpectNoError(err, "Failed to change reclaim policy of PV %v", pv.Name)
+		}
+		err = framework.WaitForPersistentVolumeDeleted(cs, pv.Name, 5*time.Second, 5*time.Minute)
+		framework.ExpectNoError(err, "Persistent Volume %v not deleted by dynamic provisioner", pv.Name)
+	}
+	r.pvs = nil
+
+	if r.sc != nil {
+		By("Deleting sc")
+		err := cs.StorageV1().StorageClasses().Delete(r.sc.Name, nil)
+		if err != nil && !apierrs.IsNotFound(err) {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		r.sc = nil
+	}
+}
+
+// getCSIClaim is the same as getClaim in the testsuites package,
+// with the addition of a storage class and configurable access modes.
+func getCSIClaim(claimSize string, ns string, scName string, accessModes ...v1.PersistentVolumeAccessMode) *v1.PersistentVolumeClaim {
+	if len(accessModes) == 0 {
+		accessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+	claim := v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "pvc-",
+			Namespace:    ns,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: &scName,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceName(v1.ResourceStorage): resource.MustParse(claimSize),
+				},
+			},
+		},
+	}
+
+	return &claim
+}
+
+// runInPodWithCSIVolume is the same as runInPodWithVolume in the
+// testsuites package: it runs the command in a pod which has the
+// volume mounted at /mnt/test and waits for it to succeed. The pod
+// is forced onto the given node because CSI drivers in this test
+// suite are usually only deployed on that one node. The output of
+// the command is returned.
+func runInPodWithCSIVolume(cs clientset.Interface, ns, claimName, nodeName, command string) string {
+	return runPodWithCSIVolume(cs, ns, claimName, nodeName, v1.Container{
+		Name:    "volume-tester",
+		Image:   imageutils.GetE2EImage(imageutils.BusyBox),
+		Command: []string{"/bin/sh"},
+		Args:    []string{"-c", command},
+	})
+}
+
+// runPodWithCSIVolume is like runInPodWithCSIVolume with a custom
+// container. The volume mount for /mnt/test gets added to it.
+func runPodWithCSIVolume(cs clientset.Interface, ns, claimName, nodeName string, container v1.Container) (output string) {
+	container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+		Name:      "my-volume",
+		MountPath: "/mnt/test",
+	})
+	pod := &v1.Pod{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "pvc-volume-tester-",
+		},
+		Spec: v1.PodSpec{
+			NodeName:      nodeName,
+			Containers:    []v1.Container{container},
+			RestartPolicy: v1.RestartPolicyNever,
+			Volumes: []v1.Volume{
+				{
+					Name: "my-volume",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+							ClaimName: claimName,
+							ReadOnly:  false,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	pod, err := cs.CoreV1().Pods(ns).Create(pod)
+	framework.ExpectNoError(err, "Failed to create pod: %v", err)
+	defer func() {
+		body, err := cs.CoreV1().Pods(ns).GetLogs(pod.Name, &v1.PodLogOptions{}).Do().Raw()
+		if err != nil {
+			framework.Logf("Error getting logs for pod %s: %v", pod.Name, err)
+		} else {
+			framework.Logf("Pod %s has the following logs: %s", pod.Name, body)
+		}
+		output = string(body)
+		framework.DeletePodOrFail(cs, ns, pod.Name)
+	}()
+	framework.ExpectNoError(framework.WaitForPodSuccessInNamespaceSlow(cs, pod.Name, pod.Namespace))
+	return
+}
+
+// getDriverPod returns the running pod of the driver deployment
+// which has the "app" label with the given value, for example
+// "csi-hostpathplugin".
+func getDriverPod(driver *manifestDriver, app string) *v1.Pod {
+	pod, err := findDriverPod(driver, app)
+	framework.ExpectNoError(err)
+	return pod
+}
+
+// findDriverPod is the same as getDriverPod, except that it returns
+// an error instead of failing the test.
+func findDriverPod(driver *manifestDriver, app string) (*v1.Pod, error) {
+	f := driver.driverInfo.Config.Framework
+	pods, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{"app": app}).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list pods with app=%s: %v", app, err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp == nil && pod.Status.Phase == v1.PodRunning {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("no running pod with app=%s in namespace %s", app, f.Namespace.Name)
+}
+
+// The mount path of the volume in pods created by
+// createPodWithCSIVolume.
+const podVolumePath = "/mnt/volume1"
+
+// createPodWithCSIVolume creates a pod which keeps running with the
+// claim mounted at podVolumePath and waits for it to run. If nodeName
+// is non-empty, the pod is forced onto that node.
+func createPodWithCSIVolume(cs clientset.Interface, ns, nodeName string, pvc *v1.PersistentVolumeClaim, readOnly bool) *v1.Pod {
+	pod := framework.MakePod(ns, nil, []*v1.PersistentVolumeClaim{pvc}, false, "")
+	pod.Spec.NodeName = nodeName
+	pod.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly = readOnly
+	return createRunningPod(cs, pod)
+}
+
+// createRunningPod creates the pod and waits for it to run.
+func createRunningPod(cs clientset.Interface, pod *v1.Pod) *v1.Pod {
+	ns := pod.Namespace
+	pod, err := cs.CoreV1().Pods(ns).Create(pod)
+	framework.ExpectNoError(err, "Failed to create pod: %v", err)
+	err = framework.WaitForPodNameRunningInNamespace(cs, pod.Name, ns)
+	framework.ExpectNoError(err, "Pod %s not running", pod.Name)
+	podName := pod.Name
+	pod, err = cs.CoreV1().Pods(ns).Get(podName, metav1.GetOptions{})
+	framework.ExpectNoError(err, "Failed to get pod %s", podName)
+	return pod
+}
+
+// getClientNodes returns the names of at most count nodes on which
+// pods can use volumes of the driver. The result is just the node
+// that the driver runs on when the driver is pinned to a single node.
+func getClientNodes(driver *manifestDriver, count int) []string {
+	nodeName := driver.driverInfo.Config.ClientNodeName
+	if driver.patchOptions.NodeName != "" {
+		return []string{driver.patchOptions.NodeName}
+	}
+
+	f := driver.driverInfo.Config.Framework
+	nodes := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+	var names []string
+	if nodeName != "" {
+		names = append(names, nodeName)
+	}
+	for _, node := range nodes.Items {
+		if len(names) >= count {
+			break
+		}
+		if node.Name != nodeName {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+// waitForClaimEvent waits for an event with the given reason for the
+// claim and returns its message. The claim must stay pending while
+// waiting.
+func waitForClaimEvent(cs clientset.Interface, pvc *v1.PersistentVolumeClaim, reason string, timeout time.Duration) string {
+	selector := fields.Set{
+		"involvedObject.kind":      "PersistentVolumeClaim",
+		"involvedObject.name":      pvc.Name,
+		"involvedObject.namespace": pvc.Namespace,
+		"reason":                   reason,
+	}.AsSelector().String()
+	var message string
+	err := wait.PollImmediate(framework.Poll, timeout, func() (bool, error) {
+		claim, err := cs.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(pvc.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if claim.Status.Phase != v1.ClaimPending {
+			return false, fmt.Errorf("claim %s is %s, expected it to stay %s", pvc.Name, claim.Status.Phase, v1.ClaimPending)
+		}
+		events, err := cs.CoreV1().Events(pvc.Namespace).List(metav1.ListOptions{FieldSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		if len(events.Items) == 0 {
+			return false, nil
+		}
+		message = events.Items[len(events.Items)-1].Message
+		return true, nil
+	})
+	framework.ExpectNoError(err, "waiting for %s event for claim %s", reason, pvc.Name)
+	framework.Logf("claim %s: %s: %s", pvc.Name, reason, message)
+	return message
+}
+
+// deleteDriverPod deletes the running driver pod with the given "app"
+// label and returns without waiting for its replacement.
+func deleteDriverPod(driver *manifestDriver, app string) *v1.Pod {
+	f := driver.driverInfo.Config.Framework
+	pod := getDriverPod(driver, app)
+	By(fmt.Sprintf("deleting driver pod %s", pod.Name))
+	err := f.ClientSet.CoreV1().Pods(pod.Namespace).Delete(pod.Name, metav1.NewDeleteOptions(0))
+	framework.ExpectNoError(err, "delete pod %s", pod.Name)
+	return pod
+}
+
+// waitForDriverPodReplaced waits until the StatefulSet or DaemonSet
+// has replaced the old pod with a new one that is running and ready.
+func waitForDriverPodReplaced(driver *manifestDriver, app string, old *v1.Pod) *v1.Pod {
+	f := driver.driverInfo.Config.Framework
+	var replacement *v1.Pod
+	By(fmt.Sprintf("waiting for replacement of driver pod %s", old.Name))
+	err := wait.PollImmediate(framework.Poll, framework.PodStartTimeout, func() (bool, error) {
+		pods, err := f.ClientSet.CoreV1().Pods(f.Namespace.Name).List(metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(labels.Set{"app": app}).String(),
+		})
+		if err != nil {
+			return false, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.UID == old.UID || pod.DeletionTimestamp != nil {
+				continue
+			}
+			if ready, _ := testutils.PodRunningReady(pod); ready {
+				replacement = pod
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	framework.ExpectNoError(err, "replacement for driver pod %s", old.Name)
+	return replacement
+}
+
+// restartDriverPod deletes the driver pod with the given "app" label
+// and waits for its replacement.
+func restartDriverPod(driver *manifestDriver, app string) *v1.Pod {
+	return waitForDriverPodReplaced(driver, app, deleteDriverPod(driver, app))
+}
+
+// execOnNode runs a shell command in the host namespaces of a node
+// via a privileged pod. That pod gets created when needed and then
+// remains running until the test namespace is deleted.
+func execOnNode(f *framework.Framework, nodeName, command string) (string, string, error) {
+	cs := f.ClientSet
+	name := "csi-host-exec-" + nodeName
+	if _, err := cs.CoreV1().Pods(f.Namespace.Name).Get(name, metav1.GetOptions{}); apierrs.IsNotFound(err) {
+		privileged := true
+		immediate := int64(0)
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: f.Namespace.Name,
+			},
+			Spec: v1.PodSpec{
+				NodeName:                      nodeName,
+				HostPID:                       true,
+				TerminationGracePeriodSeconds: &immediate,
+				Containers: []v1.Container{
+					{
+						Name:    "host-exec",
+						Image:   imageutils.GetE2EImage(imageutils.BusyBox),
+						Command: []string{"sh", "-c", "trap exit TERM; while true; do sleep 5; done"},
+						SecurityContext: &v1.SecurityContext{
+							Privileged: &privileged,
+						},
+					},
+				},
+			},
+		}
+		pod, err = cs.CoreV1().Pods(f.Namespace.Name).Create(pod)
+		if err != nil {
+			return "", "", err
+		}
+		if err := framework.WaitForPodNameRunningInNamespace(cs, name, f.Namespace.Name); err != nil {
+			return "", "", err
+		}
+	} else if err != nil {
+		return "", "", err
+	}
+	return f.ExecCommandInContainerWithFullOutput(name, "host-exec",
+		"nsenter", "--target=1", "--mount", "--uts", "--ipc", "--net", "--pid", "--",
+		"sh", "-c", command)
+}
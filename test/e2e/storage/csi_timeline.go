@@ -0,0 +1,297 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/test/e2e/framework"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// The sources in the timeline besides the pod logs, which use
+// "<pod>/<container>".
+const (
+	timelineStep  = "step"
+	timelineLog   = "log"
+	timelineEvent = "event"
+)
+
+// glogTime matches the time stamp in a glog line, for example
+// "I1019 10:11:12.123456".
+var glogTime = regexp.MustCompile(`^[IWEF](\d{4} \d{2}:\d{2}:\d{2}\.\d{6}) `)
+
+// frameworkLog matches the lines written by framework.Logf.
+var frameworkLog = regexp.MustCompile(`^\w{3} [ \d]\d \d{2}:\d{2}:\d{2}\.\d{3}: INFO: (.*)$`)
+
+// ansiEscape matches the color codes in the Ginkgo output.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+type timelineEntry struct {
+	time   time.Time
+	source string
+	text   string
+}
+
+// timeline records the By steps, framework.Logf output, pod events and
+// pod logs of one test and writes them sorted by time into
+// timeline.log, optionally also timeline.html, in the directory of
+// the test in the report directory.
+type timeline struct {
+	mutex   sync.Mutex
+	start   time.Time
+	entries []timelineEntry
+
+	// The GinkgoWriter before the test.
+	ginkgoWriter io.Writer
+}
+
+// startTimeline begins recording, if enabled. Steps and framework
+// output are captured by replacing the GinkgoWriter until finish.
+func startTimeline() *timeline {
+	if framework.TestContext.ReportDir == "" || !csiTestContext.timeline {
+		return nil
+	}
+	t := &timeline{
+		start:        time.Now(),
+		ginkgoWriter: GinkgoWriter,
+	}
+	GinkgoWriter = timelineGinkgoWriter{t}
+	return t
+}
+
+func (t *timeline) add(when time.Time, source, text string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries = append(t.entries, timelineEntry{time: when, source: source, text: text})
+}
+
+// timelineGinkgoWriter records the steps and framework output and
+// passes everything on to the original GinkgoWriter.
+type timelineGinkgoWriter struct {
+	*timeline
+}
+
+func (w timelineGinkgoWriter) Write(data []byte) (int, error) {
+	now := time.Now()
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		line = ansiEscape.ReplaceAllString(line, "")
+		if strings.HasPrefix(line, "STEP: ") {
+			w.add(now, timelineStep, strings.TrimPrefix(line, "STEP: "))
+		} else if match := frameworkLog.FindStringSubmatch(line); match != nil {
+			w.add(now, timelineLog, match[1])
+		}
+	}
+	return w.ginkgoWriter.Write(data)
+}
+
+// podLogWriter records the output of podlogs.CopyAllLogs and passes
+// it on to next. glog lines get the time stamp from the line,
+// everything else the time when it arrived.
+func (t *timeline) podLogWriter(next io.Writer) io.Writer {
+	return timelinePodLogs{t, next}
+}
+
+type timelinePodLogs struct {
+	*timeline
+	next io.Writer
+}
+
+func (w timelinePodLogs) Write(data []byte) (int, error) {
+	now := time.Now()
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		w.add(w.logTime(parts[1], now), parts[0], parts[1])
+	}
+	return w.next.Write(data)
+}
+
+// logTime parses the time stamp of a glog line. glog has neither
+// year nor time zone, so UTC and the current year are assumed, which
+// is what the driver containers normally use. Time stamps that are
+// off by more than a minute are not trusted.
+func (t *timeline) logTime(line string, now time.Time) time.Time {
+	match := glogTime.FindStringSubmatch(line)
+	if match == nil {
+		return now
+	}
+	stamp, err := time.ParseInLocation("0102 15:04:05.000000", match[1], time.UTC)
+	if err != nil {
+		return now
+	}
+	stamp = stamp.AddDate(now.Year(), 0, 0)
+	if diff := now.Sub(stamp); diff > time.Minute || diff < -time.Minute {
+		return now
+	}
+	return stamp
+}
+
+// eventWriter records the output of podlogs.WatchPods and passes it
+// on to next.
+func (t *timeline) eventWriter(next io.Writer) io.Writer {
+	return timelineEvents{t, next}
+}
+
+type timelineEvents struct {
+	*timeline
+	next io.Writer
+}
+
+func (w timelineEvents) Write(data []byte) (int, error) {
+	now := time.Now()
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		w.add(now, timelineEvent, strings.TrimPrefix(line, "pod event: "))
+	}
+	return w.next.Write(data)
+}
+
+// finish restores the GinkgoWriter and writes the timeline. Output
+// that arrives later is still recorded, but no longer written.
+func (t *timeline) finish(write bool) {
+	GinkgoWriter = t.ginkgoWriter
+	if !write {
+		return
+	}
+
+	t.mutex.Lock()
+	entries := append([]timelineEntry(nil), t.entries...)
+	t.mutex.Unlock()
+	// Stable, so that lines from the same source with the same
+	// time stamp stay in order.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+
+	dir := path.Join(framework.TestContext.ReportDir, testFileName())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		framework.Logf("creating %s failed: %v", dir, err)
+		return
+	}
+	if err := t.writeFile(path.Join(dir, "timeline.log"), func(w io.Writer) error {
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s [%s] %s\n", t.relative(entry), entry.source, entry.text)
+		}
+		return nil
+	}); err != nil {
+		framework.Logf("writing timeline failed: %v", err)
+	}
+	if !csiTestContext.timelineHTML {
+		return
+	}
+	if err := t.writeFile(path.Join(dir, "timeline.html"), func(w io.Writer) error {
+		return t.writeHTML(w, entries)
+	}); err != nil {
+		framework.Logf("writing timeline failed: %v", err)
+	}
+}
+
+// relative returns the time of the entry since the start of the test,
+// for example "+12.345s".
+func (t *timeline) relative(entry timelineEntry) string {
+	return fmt.Sprintf("%+10.3fs", entry.time.Sub(t.start).Seconds())
+}
+
+func (t *timeline) writeFile(fileName string, write func(w io.Writer) error) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if err := write(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+var timelineHTML = template.Must(template.New("timeline").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Test}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 8px; vertical-align: top; white-space: pre-wrap; }
+tr.step { font-weight: bold; background: #e3f2fd; }
+tr.event { background: #fff8e1; }
+label { margin-right: 12px; }
+</style>
+<script>
+function filter() {
+  var shown = {};
+  document.querySelectorAll("input[data-source]").forEach(function(box) {
+    shown[box.dataset.source] = box.checked;
+  });
+  document.querySelectorAll("tr[data-source]").forEach(function(row) {
+    row.style.display = shown[row.dataset.source] ? "" : "none";
+  });
+}
+</script>
+</head>
+<body>
+<h1>{{.Test}}</h1>
+<p>{{range .Sources}}<label><input type="checkbox" checked data-source="{{.}}" onchange="filter()">{{.}}</label>{{end}}</p>
+<table>
+{{range .Entries}}<tr class="{{.Class}}" data-source="{{.Source}}"><td>{{.Time}}</td><td>{{.Source}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeHTML writes the entries as a table with one checkbox per source
+// for filtering.
+func (t *timeline) writeHTML(w io.Writer, entries []timelineEntry) error {
+	type row struct {
+		Time, Source, Class, Text string
+	}
+	data := struct {
+		Test    string
+		Sources []string
+		Entries []row
+	}{
+		Test: CurrentGinkgoTestDescription().FullTestText,
+	}
+	sources := map[string]bool{}
+	for _, entry := range entries {
+		if !sources[entry.source] {
+			sources[entry.source] = true
+			data.Sources = append(data.Sources, entry.source)
+		}
+		class := entry.source
+		if strings.Contains(class, "/") {
+			class = "pod"
+		}
+		data.Entries = append(data.Entries, row{t.relative(entry), entry.source, class, entry.text})
+	}
+	sort.Strings(data.Sources)
+	return timelineHTML.Execute(w, data)
+}
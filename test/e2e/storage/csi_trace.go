@@ -0,0 +1,311 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/onsi/gomega/types"
+	"k8s.io/kubernetes/test/e2e/framework"
+
+	"github.com/kubernetes-csi/csi-e2e/pkg/csiproxy"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// getProxyTrace retrieves all CSI calls recorded by the proxy since
+// the driver was deployed.
+func getProxyTrace(driver *manifestDriver) ([]csiproxy.Call, error) {
+	output, err := execCSIProxy(driver, "get-trace")
+	if err != nil {
+		return nil, err
+	}
+	var trace []csiproxy.Call
+	if err := json.Unmarshal([]byte(output), &trace); err != nil {
+		return nil, fmt.Errorf("decode CSI trace: %v", err)
+	}
+	return trace, nil
+}
+
+// fileNameUnsafe matches all characters that are replaced when
+// turning a test name into a file name.
+var fileNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// testFileName turns the full name of the current test into a file
+// name. Long names get truncated and a hash of the full name is added
+// to keep them unique.
+func testFileName() string {
+	text := CurrentGinkgoTestDescription().FullTestText
+	name := fileNameUnsafe.ReplaceAllString(text, "_")
+	if len(name) > 200 {
+		hash := fnv.New32a()
+		hash.Write([]byte(text))
+		name = fmt.Sprintf("%s-%08x", name[:200], hash.Sum32())
+	}
+	return name
+}
+
+// saveProxyTrace writes the trace of the current test as JSON file
+// into the "csi-trace" sub-directory of the report directory. This is
+// best effort: problems are only logged because the trace is needed
+// for debugging and should not cause tests to fail.
+func saveProxyTrace(driver *manifestDriver) {
+	if framework.TestContext.ReportDir == "" {
+		return
+	}
+	trace, err := getProxyTrace(driver)
+	if err != nil {
+		framework.Logf("retrieving CSI trace failed: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(trace, "", "  ")
+	if err != nil {
+		framework.Logf("encoding CSI trace failed: %v", err)
+		return
+	}
+
+	dir := path.Join(framework.TestContext.ReportDir, "csi-trace")
+	fileName := path.Join(dir, fmt.Sprintf("%s-%s.json", testFileName(), driver.driverInfo.Config.Framework.UniqueName))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		framework.Logf("creating %s failed: %v", dir, err)
+		return
+	}
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		framework.Logf("writing CSI trace failed: %v", err)
+		return
+	}
+	framework.Logf("CSI trace with %d calls written to %s", len(trace), fileName)
+}
+
+// traceMatcher implements the Gomega matcher interface for a CSI
+// trace ([]csiproxy.Call) with a function that returns all problems
+// found in the trace.
+type traceMatcher struct {
+	description string
+	check       func(trace []csiproxy.Call) []string
+	problems    []string
+}
+
+var _ types.GomegaMatcher = &traceMatcher{}
+
+func (m *traceMatcher) Match(actual interface{}) (bool, error) {
+	trace, ok := actual.([]csiproxy.Call)
+	if !ok {
+		return false, fmt.Errorf("expected a CSI trace ([]csiproxy.Call), got %T", actual)
+	}
+	m.problems = m.check(trace)
+	return len(m.problems) == 0, nil
+}
+
+func (m *traceMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected CSI trace to %s:\n    %s", m.description, strings.Join(m.problems, "\n    "))
+}
+
+func (m *traceMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected CSI trace not to %s", m.description)
+}
+
+// describeCall is used in failure messages.
+func describeCall(call csiproxy.Call, fields ...string) string {
+	description := fmt.Sprintf("%s %s", call.Time.Format("15:04:05.000"), call.ShortMethod())
+	for _, field := range fields {
+		description += fmt.Sprintf(" %s=%v", field, call.Request[field])
+	}
+	return description
+}
+
+// publishPairs lists the CSI calls that need to be undone by
+// another call and the request fields that identify the operation.
+var publishPairs = []struct {
+	publish, unpublish string
+	fields             []string
+}{
+	{"ControllerPublishVolume", "ControllerUnpublishVolume", []string{"volume_id", "node_id"}},
+	{"NodeStageVolume", "NodeUnstageVolume", []string{"volume_id", "staging_target_path"}},
+	{"NodePublishVolume", "NodeUnpublishVolume", []string{"volume_id", "target_path"}},
+}
+
+// haveMatchingUnpublishCalls succeeds if every successful
+// ControllerPublishVolume, NodeStageVolume and NodePublishVolume call
+// is followed by a successful ControllerUnpublishVolume,
+// NodeUnstageVolume resp. NodeUnpublishVolume call for the same
+// volume and node or path.
+func haveMatchingUnpublishCalls() types.GomegaMatcher {
+	return &traceMatcher{
+		description: "have a matching unpublish call for each publish call",
+		check: func(trace []csiproxy.Call) []string {
+			var problems []string
+			for _, pair := range publishPairs {
+				published := map[string]csiproxy.Call{}
+				for _, call := range trace {
+					if call.Failed() {
+						continue
+					}
+					var key []string
+					for _, field := range pair.fields {
+						key = append(key, fmt.Sprintf("%v", call.Request[field]))
+					}
+					switch call.ShortMethod() {
+					case pair.publish:
+						published[strings.Join(key, "/")] = call
+					case pair.unpublish:
+						delete(published, strings.Join(key, "/"))
+					}
+				}
+				for _, call := range published {
+					problems = append(problems, fmt.Sprintf("%s without %s", describeCall(call, pair.fields...), pair.unpublish))
+				}
+			}
+			return problems
+		},
+	}
+}
+
+// haveNoFailedCallsExceptInjected succeeds if all calls succeeded,
+// except for those where the proxy injected a fault.
+func haveNoFailedCallsExceptInjected() types.GomegaMatcher {
+	return &traceMatcher{
+		description: "have no failed calls except those with injected faults",
+		check: func(trace []csiproxy.Call) []string {
+			var problems []string
+			for _, call := range trace {
+				if call.Failed() && !call.Injected {
+					problems = append(problems, fmt.Sprintf("%s: %s: %s", describeCall(call), call.Code, call.Error))
+				}
+			}
+			return problems
+		},
+	}
+}
+
+// haveCallBefore succeeds if each successful call of the second
+// method is preceded by a successful call of the first method for
+// the same volume since the previous successful call of the second
+// method, for example haveCallBefore("NodeUnpublishVolume",
+// "NodeUnstageVolume").
+func haveCallBefore(first, then string) types.GomegaMatcher {
+	return &traceMatcher{
+		description: fmt.Sprintf("have %s before each %s of the same volume", first, then),
+		check: func(trace []csiproxy.Call) []string {
+			var problems []string
+			seen := map[string]bool{}
+			for _, call := range trace {
+				if call.Failed() {
+					continue
+				}
+				volumeID := fmt.Sprintf("%v", call.Request["volume_id"])
+				switch call.ShortMethod() {
+				case first:
+					seen[volumeID] = true
+				case then:
+					if !seen[volumeID] {
+						problems = append(problems, fmt.Sprintf("%s without prior %s", describeCall(call, "volume_id"), first))
+					}
+					seen[volumeID] = false
+				}
+			}
+			return problems
+		},
+	}
+}
+
+// haveCallWithFields succeeds if there is a successful call of the
+// method with the given request fields. Values are compared in their
+// "%v" representation, so a bool field that is true must be given as
+// "1" and an unset field as "<nil>".
+func haveCallWithFields(method string, fields map[string]string) types.GomegaMatcher {
+	return &traceMatcher{
+		description: fmt.Sprintf("have a %s call with %v", method, fields),
+		check: func(trace []csiproxy.Call) []string {
+			var calls []string
+			for _, call := range trace {
+				if call.ShortMethod() != method || call.Failed() {
+					continue
+				}
+				match := true
+				var names []string
+				for field, value := range fields {
+					names = append(names, field)
+					if fmt.Sprintf("%v", call.Request[field]) != value {
+						match = false
+					}
+				}
+				if match {
+					return nil
+				}
+				sort.Strings(names)
+				calls = append(calls, describeCall(call, names...))
+			}
+			if len(calls) == 0 {
+				return []string{fmt.Sprintf("no successful %s calls", method)}
+			}
+			return calls
+		},
+	}
+}
+
+// haveNoCallsOf succeeds if the method was not called at all, for
+// example haveNoCallsOf("DeleteVolume").
+func haveNoCallsOf(method string) types.GomegaMatcher {
+	return &traceMatcher{
+		description: fmt.Sprintf("have no %s calls", method),
+		check: func(trace []csiproxy.Call) []string {
+			var problems []string
+			for _, call := range trace {
+				if call.ShortMethod() == method {
+					problems = append(problems, describeCall(call, "volume_id"))
+				}
+			}
+			return problems
+		},
+	}
+}
+
+// haveRetriesWithSameField succeeds if the method was called more
+// than once and all calls had the same value for the request field,
+// for example haveRetriesWithSameField("CreateVolume", "name").
+func haveRetriesWithSameField(method, field string) types.GomegaMatcher {
+	return &traceMatcher{
+		description: fmt.Sprintf("have retries of %s with the same %s", method, field),
+		check: func(trace []csiproxy.Call) []string {
+			var calls []csiproxy.Call
+			for _, call := range trace {
+				if call.ShortMethod() == method {
+					calls = append(calls, call)
+				}
+			}
+			if len(calls) < 2 {
+				return []string{fmt.Sprintf("%d call(s) of %s", len(calls), method)}
+			}
+			var problems []string
+			for _, call := range calls[1:] {
+				if fmt.Sprintf("%v", call.Request[field]) != fmt.Sprintf("%v", calls[0].Request[field]) {
+					problems = append(problems, fmt.Sprintf("%s differs from first call with %s=%v", describeCall(call, field), field, calls[0].Request[field]))
+				}
+			}
+			return problems
+		},
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// driverVersion is one version of a driver deployment.
+type driverVersion struct {
+	// A name for log messages, for example "v0.4.0".
+	name string
+	// The manifests of this version. If empty, the manifests
+	// of the driver are used.
+	manifests []string
+	// Replaces the image of containers with the given name.
+	images map[string]string
+}
+
+// driverUpgrade contains the old and the new version of a driver.
+type driverUpgrade struct {
+	from, to driverVersion
+}
+
+// manifestFiles returns the manifests of the current version.
+func (m *manifestDriver) manifestFiles() []string {
+	if m.version != nil && len(m.version.manifests) > 0 {
+		return m.version.manifests
+	}
+	return m.manifests
+}
+
+// patchImages replaces container images as configured for the
+// current version.
+func (m *manifestDriver) patchImages(item interface{}) {
+	spec := getPodSpec(item)
+	if spec == nil || m.version == nil {
+		return
+	}
+	for i := range spec.Containers {
+		if image, ok := m.version.images[spec.Containers[i].Name]; ok {
+			spec.Containers[i].Image = image
+		}
+	}
+}
+
+// rollDriver updates the running driver deployment to the version.
+// The items from the manifests go through the same patching as in
+// CreateDriver. The pod templates of existing DaemonSets,
+// StatefulSets and Deployments get replaced, new items get created
+// and are removed again by CleanupDriver.
+func (m *manifestDriver) rollDriver(version *driverVersion) {
+	By(fmt.Sprintf("rolling %s driver to version %s", m.driverInfo.Name, version.name))
+	f := m.driverInfo.Config.Framework
+	cs := f.ClientSet
+	m.version = version
+
+	items, err := f.LoadFromManifests(m.manifestFiles()...)
+	framework.ExpectNoError(err, "load manifests of version %s", version.name)
+	err = f.PatchItems(items...)
+	framework.ExpectNoError(err, "patch manifests of version %s", version.name)
+	var cleanups []func()
+	defer func() {
+		cleanup := m.cleanup
+		m.cleanup = func() {
+			for _, c := range cleanups {
+				c()
+			}
+			if cleanup != nil {
+				cleanup()
+			}
+		}
+	}()
+	for _, item := range items {
+		err := m.patchItem(item)
+		framework.ExpectNoError(err, "patch %s", framework.DescribeItem(item))
+		updated, err := updatePodTemplate(cs, item)
+		framework.ExpectNoError(err, "update %s", framework.DescribeItem(item))
+		if updated {
+			continue
+		}
+		cleanup, err := f.CreateItems(item)
+		if err != nil && apierrs.IsAlreadyExists(errors.Cause(err)) {
+			continue
+		}
+		framework.ExpectNoError(err, "create %s", framework.DescribeItem(item))
+		cleanups = append(cleanups, cleanup)
+	}
+
+	for _, item := range items {
+		if getPodSpec(item) != nil {
+			By(fmt.Sprintf("waiting for rollout of %s", framework.DescribeItem(item)))
+			framework.ExpectNoError(waitForRollout(cs, item), "rollout of %s", framework.DescribeItem(item))
+		}
+	}
+}
+
+// updatePodTemplate replaces the pod template of an existing
+// DaemonSet, StatefulSet or Deployment with the one from the item.
+// It returns false for other items and items which do not exist yet.
+func updatePodTemplate(cs clientset.Interface, item interface{}) (bool, error) {
+	var err error
+	switch item := item.(type) {
+	case *appsv1.DaemonSet:
+		var existing *appsv1.DaemonSet
+		existing, err = cs.AppsV1().DaemonSets(item.Namespace).Get(item.Name, metav1.GetOptions{})
+		if err == nil {
+			existing.Spec.Template = item.Spec.Template
+			_, err = cs.AppsV1().DaemonSets(item.Namespace).Update(existing)
+		}
+	case *appsv1.StatefulSet:
+		var existing *appsv1.StatefulSet
+		existing, err = cs.AppsV1().StatefulSets(item.Namespace).Get(item.Name, metav1.GetOptions{})
+		if err == nil {
+			existing.Spec.Template = item.Spec.Template
+			_, err = cs.AppsV1().StatefulSets(item.Namespace).Update(existing)
+		}
+	case *appsv1.Deployment:
+		var existing *appsv1.Deployment
+		existing, err = cs.AppsV1().Deployments(item.Namespace).Get(item.Name, metav1.GetOptions{})
+		if err == nil {
+			existing.Spec.Template = item.Spec.Template
+			_, err = cs.AppsV1().Deployments(item.Namespace).Update(existing)
+		}
+	default:
+		return false, nil
+	}
+	if apierrs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// waitForRollout waits until all pods of a DaemonSet, StatefulSet or
+// Deployment run with the current pod template and are available.
+func waitForRollout(cs clientset.Interface, item interface{}) error {
+	return wait.PollImmediate(framework.Poll, framework.PodStartTimeout, func() (bool, error) {
+		switch item := item.(type) {
+		case *appsv1.DaemonSet:
+			ds, err := cs.AppsV1().DaemonSets(item.Namespace).Get(item.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return ds.Status.ObservedGeneration >= ds.Generation &&
+				ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled &&
+				ds.Status.NumberAvailable == ds.Status.DesiredNumberScheduled, nil
+		case *appsv1.StatefulSet:
+			ss, err := cs.AppsV1().StatefulSets(item.Namespace).Get(item.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return ss.Status.ObservedGeneration >= ss.Generation &&
+				ss.Status.CurrentRevision == ss.Status.UpdateRevision &&
+				ss.Status.ReadyReplicas == *ss.Spec.Replicas, nil
+		case *appsv1.Deployment:
+			d, err := cs.AppsV1().Deployments(item.Namespace).Get(item.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			return d.Status.ObservedGeneration >= d.Generation &&
+				d.Status.UpdatedReplicas == *d.Spec.Replicas &&
+				d.Status.AvailableReplicas == *d.Spec.Replicas, nil
+		}
+		return true, nil
+	})
+}
+
+type upgradeTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &upgradeTestSuite{}
+
+// initUpgradeTestSuite returns upgradeTestSuite that implements csiTestSuite interface
+func initUpgradeTestSuite() csiTestSuite {
+	return &upgradeTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "upgrade",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *upgradeTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *upgradeTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if driver.upgrade == nil {
+		framework.Skipf("Driver %s has no upgrade versions -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *upgradeTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+			pod          *v1.Pod
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+			resource = csiVolumeTestResource{}
+			pod = nil
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				f := driver.driverInfo.Config.Framework
+				if pod != nil {
+					framework.ExpectNoError(framework.DeletePodWithWait(f, f.ClientSet, pod))
+				}
+				resource.cleanupResource(driver, pattern)
+				// The driver gets removed after this, the
+				// next test starts with the default version.
+				driver.version = nil
+			}
+		})
+
+		// testUpgrade deploys the old version, uses it, rolls the
+		// driver to the new version and then checks the old and a
+		// new volume.
+		testUpgrade := func(from, to *driverVersion) {
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			driver.version = from
+			driver.reinstallDriver()
+			if driver.driverPods.plugin != "" {
+				waitForRegistration(driver, nodeName, true)
+			}
+			resource.setupResource(driver, pattern)
+
+			By(fmt.Sprintf("using version %s", from.name))
+			oldClaim, oldVolume := resource.createBoundClaim("")
+			pod = createPodWithCSIVolume(cs, oldClaim.Namespace, nodeName, oldClaim, false)
+			container := pod.Spec.Containers[0].Name
+			written, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, container,
+				"sh", "-c", fmt.Sprintf("dd if=/dev/urandom of=%[1]s bs=1024 count=64 2>/dev/null && sha256sum %[1]s", podVolumePath+"/data"))
+			framework.ExpectNoError(err, "write data: %s", stderr)
+
+			driver.rollDriver(to)
+			if driver.driverPods.plugin != "" {
+				waitForRegistration(driver, nodeName, true)
+			}
+
+			// The data of drivers which lose data on restart is
+			// gone together with the old driver pods, but the
+			// existing mount must still be usable.
+			By("checking the existing mount")
+			if driver.restartLosesData {
+				framework.Logf("Driver %s loses data when restarted, skipping the checksum of the data written before the upgrade", driver.driverInfo.Name)
+			} else {
+				read, stderr, err := f.ExecCommandInContainerWithFullOutput(pod.Name, container, "sha256sum", podVolumePath+"/data")
+				framework.ExpectNoError(err, "read data: %s", stderr)
+				Expect(read).To(Equal(written), "checksum of the data")
+			}
+			_, stderr, err = f.ExecCommandInContainerWithFullOutput(pod.Name, container, "sh", "-c", fmt.Sprintf("echo hello > %[1]s && grep -q hello %[1]s", podVolumePath+"/after-upgrade"))
+			framework.ExpectNoError(err, "write after upgrade: %s", stderr)
+
+			By(fmt.Sprintf("provisioning a new volume with version %s", to.name))
+			newClaim, _ := resource.createBoundClaim("")
+			runInPodWithCSIVolume(cs, newClaim.Namespace, newClaim.Name, nodeName, "echo hello > /mnt/test/data && grep -q hello /mnt/test/data")
+
+			if driver.restartLosesData {
+				framework.Logf("Driver %s loses data when restarted, skipping mounting the old volume again with version %s", driver.driverInfo.Name, to.name)
+			} else {
+				By(fmt.Sprintf("mounting the old volume again with version %s", to.name))
+				Expect(readDataChecksum(cs, oldClaim, nodeName)).To(Equal(strings.Fields(written)[0]), "checksum of the data")
+			}
+
+			By(fmt.Sprintf("unmounting and deleting the old volume with version %s", to.name))
+			framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+			pod = nil
+			err = framework.DeletePersistentVolumeClaim(cs, oldClaim.Name, oldClaim.Namespace)
+			framework.ExpectNoError(err, "delete claim %s", oldClaim.Name)
+			err = framework.WaitForPersistentVolumeDeleted(cs, oldVolume.Name, framework.Poll, framework.PVDeletingTimeout)
+			framework.ExpectNoError(err, "PV %s not deleted", oldVolume.Name)
+		}
+
+		It("should keep volumes working when upgrading the driver", func() {
+			testUpgrade(&driver.upgrade.from, &driver.upgrade.to)
+		})
+
+		It("should keep volumes working when downgrading the driver", func() {
+			testUpgrade(&driver.upgrade.to, &driver.upgrade.from)
+		})
+	})
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/framework/metrics"
+	"k8s.io/kubernetes/test/e2e/storage/testpatterns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	// statsDataSize is the amount of data in MiB that gets written
+	// into the volume.
+	statsDataSize = 10
+
+	// statsTolerance is the relative deviation from the expected
+	// used bytes that is still accepted, because file system
+	// overhead depends on the driver.
+	statsTolerance = 0.1
+
+	// statsTimeout must be larger than the kubelet
+	// --volume-stats-agg-period (one minute by default).
+	statsTimeout = 3 * time.Minute
+)
+
+// The kubelet metrics that are checked for each volume.
+const (
+	volumeStatsUsedBytes      = "kubelet_volume_stats_used_bytes"
+	volumeStatsCapacityBytes  = "kubelet_volume_stats_capacity_bytes"
+	volumeStatsAvailableBytes = "kubelet_volume_stats_available_bytes"
+	volumeStatsInodes         = "kubelet_volume_stats_inodes"
+	volumeStatsInodesUsed     = "kubelet_volume_stats_inodes_used"
+	volumeStatsInodesFree     = "kubelet_volume_stats_inodes_free"
+)
+
+var volumeStatsMetrics = []string{
+	volumeStatsUsedBytes,
+	volumeStatsCapacityBytes,
+	volumeStatsAvailableBytes,
+	volumeStatsInodes,
+	volumeStatsInodesUsed,
+	volumeStatsInodesFree,
+}
+
+type volumeStatsTestSuite struct {
+	tsInfo csiTestSuiteInfo
+}
+
+var _ csiTestSuite = &volumeStatsTestSuite{}
+
+// initVolumeStatsTestSuite returns volumeStatsTestSuite that implements csiTestSuite interface
+func initVolumeStatsTestSuite() csiTestSuite {
+	return &volumeStatsTestSuite{
+		tsInfo: csiTestSuiteInfo{
+			name: "volume stats",
+			testPatterns: []testpatterns.TestPattern{
+				testpatterns.DefaultFsDynamicPV,
+			},
+		},
+	}
+}
+
+func (t *volumeStatsTestSuite) getTestSuiteInfo() csiTestSuiteInfo {
+	return t.tsInfo
+}
+
+func (t *volumeStatsTestSuite) skipUnsupportedTest(pattern testpatterns.TestPattern, driver *manifestDriver) {
+	if !driver.volumeStats {
+		framework.Skipf("Driver %s doesn't implement NodeGetVolumeStats -- skipping", driver.driverInfo.Name)
+	}
+}
+
+func (t *volumeStatsTestSuite) execTest(driver *manifestDriver, pattern testpatterns.TestPattern) {
+	Context(getCSITestNameStr(t, pattern), func() {
+		var (
+			resource     csiVolumeTestResource
+			needsCleanup bool
+		)
+
+		BeforeEach(func() {
+			needsCleanup = false
+			// Skip unsupported tests to avoid unnecessary resource initialization
+			skipUnsupportedCSITest(t, driver, pattern)
+			needsCleanup = true
+
+			resource = csiVolumeTestResource{}
+			resource.setupResource(driver, pattern)
+		})
+
+		AfterEach(func() {
+			if needsCleanup {
+				resource.cleanupResource(driver, pattern)
+			}
+		})
+
+		It("should report volume stats metrics for mounted volumes", func() {
+			f := driver.driverInfo.Config.Framework
+			cs := f.ClientSet
+			nodeName := driver.driverInfo.Config.ClientNodeName
+
+			grabber, err := metrics.NewMetricsGrabber(cs, nil, true, false, false, false, false)
+			framework.ExpectNoError(err, "create metrics grabber")
+
+			pvc, _ := resource.createBoundClaim(fmt.Sprintf("%dMi", 2*statsDataSize))
+			pod := createPodWithCSIVolume(cs, pvc.Namespace, nodeName, pvc, false)
+			defer func() {
+				framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+			}()
+
+			// The capacity can only be compared with the claim
+			// when the filesystem has the size of the volume.
+			// It may be smaller because of filesystem overhead,
+			// but not larger.
+			claimCapacity := pvc.Status.Capacity[v1.ResourceStorage]
+			claimSize := float64(claimCapacity.Value())
+			checkCapacity := driver.capacity != nil && driver.capacity.filesystemSize
+			before := waitForVolumeStats(grabber, nodeName, pvc, func(stats map[string]float64) string {
+				capacity := stats[volumeStatsCapacityBytes]
+				if checkCapacity && (capacity < claimSize*(100-filesystemOverheadPercent)/100 || capacity > claimSize) {
+					return fmt.Sprintf("capacity %.0f does not match the claim capacity %.0f within %d%%", capacity, claimSize, filesystemOverheadPercent)
+				}
+				return ""
+			})
+
+			By(fmt.Sprintf("writing %dMiB into the volume", statsDataSize))
+			_, stderr, err := f.ExecShellInPodWithFullOutput(pod.Name,
+				fmt.Sprintf("dd if=/dev/urandom of=%s/data bs=1048576 count=%d && sync", podVolumePath, statsDataSize))
+			Expect(err).NotTo(HaveOccurred(), "write into pod %s: %s", pod.Name, stderr)
+
+			written := float64(statsDataSize * 1024 * 1024)
+			waitForVolumeStats(grabber, nodeName, pvc, func(stats map[string]float64) string {
+				used := stats[volumeStatsUsedBytes] - before[volumeStatsUsedBytes]
+				switch {
+				case used < written*(1-statsTolerance) || used > written*(1+statsTolerance):
+					return fmt.Sprintf("used bytes increased by %.0f instead of %.0f", used, written)
+				case stats[volumeStatsInodesUsed] <= before[volumeStatsInodesUsed]:
+					return fmt.Sprintf("used inodes did not increase: %.0f", stats[volumeStatsInodesUsed])
+				}
+				return ""
+			})
+
+			By("unmounting the volume")
+			framework.ExpectNoError(framework.DeletePodWithWait(f, cs, pod))
+			pod = nil
+
+			By(fmt.Sprintf("waiting for the volume stats of claim %s to disappear", pvc.Name))
+			var remaining map[string]float64
+			err = wait.PollImmediate(framework.Poll, statsTimeout, func() (bool, error) {
+				remaining = getVolumeStats(grabber, nodeName, pvc)
+				return len(remaining) == 0, nil
+			})
+			Expect(err).NotTo(HaveOccurred(), "volume stats after unmount: %v", remaining)
+		})
+	})
+}
+
+// getVolumeStats returns the value of each volume stats metric that
+// kubelet reports for the claim. Metrics which are not reported
+// are not included.
+func getVolumeStats(grabber *metrics.MetricsGrabber, nodeName string, pvc *v1.PersistentVolumeClaim) map[string]float64 {
+	kubeletMetrics, err := grabber.GrabFromKubelet(nodeName)
+	framework.ExpectNoError(err, "get metrics from kubelet on node %s", nodeName)
+	stats := map[string]float64{}
+	for _, name := range volumeStatsMetrics {
+		for _, sample := range kubeletMetrics[name] {
+			if sample.Metric["namespace"] == model.LabelValue(pvc.Namespace) &&
+				sample.Metric["persistentvolumeclaim"] == model.LabelValue(pvc.Name) {
+				stats[name] = float64(sample.Value)
+			}
+		}
+	}
+	return stats
+}
+
+// waitForVolumeStats waits until kubelet reports all volume stats
+// metrics for the claim, the metrics are consistent and the check
+// function (which returns a description of the problem or an empty
+// string) accepts them.
+func waitForVolumeStats(grabber *metrics.MetricsGrabber, nodeName string, pvc *v1.PersistentVolumeClaim, check func(stats map[string]float64) string) map[string]float64 {
+	By(fmt.Sprintf("waiting for volume stats of claim %s on node %s", pvc.Name, nodeName))
+	var (
+		stats   map[string]float64
+		problem string
+	)
+	err := wait.PollImmediate(framework.Poll, statsTimeout, func() (bool, error) {
+		stats = getVolumeStats(grabber, nodeName, pvc)
+		problem = checkVolumeStats(stats)
+		if problem == "" {
+			problem = check(stats)
+		}
+		return problem == "", nil
+	})
+	if err == wait.ErrWaitTimeout {
+		framework.Failf("volume stats of claim %s: %s (%v)", pvc.Name, problem, stats)
+	}
+	framework.ExpectNoError(err)
+	return stats
+}
+
+// checkVolumeStats checks that all metrics are present and consistent
+// with each other and returns a description of the problem if not.
+func checkVolumeStats(stats map[string]float64) string {
+	for _, name := range volumeStatsMetrics {
+		if _, ok := stats[name]; !ok {
+			return fmt.Sprintf("%s missing", name)
+		}
+	}
+	switch {
+	case stats[volumeStatsCapacityBytes] <= 0:
+		return "capacity is zero"
+	case stats[volumeStatsUsedBytes] > stats[volumeStatsCapacityBytes]:
+		return "used bytes larger than capacity"
+	case stats[volumeStatsAvailableBytes] > stats[volumeStatsCapacityBytes]:
+		return "available bytes larger than capacity"
+	case stats[volumeStatsInodes] <= 0:
+		return "inode count is zero"
+	case stats[volumeStatsInodesUsed]+stats[volumeStatsInodesFree] > stats[volumeStatsInodes]:
+		return "used plus free inodes larger than inode count"
+	}
+	return ""
+}
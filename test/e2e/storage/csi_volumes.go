@@ -19,9 +19,13 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"path"
 	"strings"
 
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -59,41 +63,101 @@ var _ = Describe("CSI Volumes", func() {
 		ns     *v1.Namespace
 		ctx    context.Context
 		cancel context.CancelFunc
+
+		eventsFile   *os.File
+		podLogs      *podLogBuffer
+		podLogFiles  *podLogFiles
+		testTimeline *timeline
 	)
 
 	BeforeEach(func() {
 		cs = f.ClientSet
 		ns = f.Namespace
+		leaks.beforeTest(f)
 		// These local variables are needed to appease "go vet".
 		// It warns about not calling cancel otherwise.
 		c, cncl := context.WithCancel(context.Background())
 		ctx = c
 		cancel = cncl
 
-		// We copy all output from pods directly to the
-		// GingkoWriter.
-		//
-		// When using a more elaborate CI system which uses
-		// the --report-dir feature to capture log files, then
-		// see k8s.io/kubernetes/test/e2e/storage/csi_volumes.go
-		// for an example how the output can also get
-		// redirected to log files.
+		// Without --report-dir, all output from pods gets
+		// copied directly to the GinkgoWriter. With it, each
+		// test gets its own directory in the report directory
+		// with one log file per container and the pod events,
+		// so that CI systems can attach them to the test.
+		// With -csi.pod-logs=on-failure, the output is buffered
+		// and only written in AfterEach if the test failed.
 		to := podlogs.LogOutput{
 			StatusWriter: GinkgoWriter,
-			LogWriter:    GinkgoWriter,
+		}
+		var events io.Writer = GinkgoWriter
+		switch {
+		case csiTestContext.podLogs == podLogsOnFailure:
+			var err error
+			podLogs, err = newPodLogBuffer()
+			framework.ExpectNoError(err, "pod log buffer")
+			to.LogWriter = podLogs
+			events = podLogs.eventWriter()
+		case csiTestContext.podLogs != podLogsAlways:
+			framework.Failf("unknown -csi.pod-logs %q, must be %q or %q", csiTestContext.podLogs, podLogsAlways, podLogsOnFailure)
+		case framework.TestContext.ReportDir == "":
+			to.LogWriter = GinkgoWriter
+		default:
+			dir := path.Join(framework.TestContext.ReportDir, testFileName())
+			to.LogPathPrefix = dir + "/"
+			err := os.MkdirAll(dir, 0755)
+			framework.ExpectNoError(err, "create %s", dir)
+			// The same test might run more than once, for
+			// example in soak mode, so append.
+			eventsFile, err = os.OpenFile(path.Join(dir, "pod-events.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			framework.ExpectNoError(err, "create pod events file")
+			events = eventsFile
+		}
+		// The timeline needs to see each line, so then the
+		// pod output cannot go directly into files.
+		if testTimeline = startTimeline(); testTimeline != nil {
+			if to.LogWriter == nil {
+				podLogFiles = newPodLogFiles(to.LogPathPrefix)
+				to.LogWriter = podLogFiles
+			}
+			to.LogWriter = testTimeline.podLogWriter(to.LogWriter)
+			events = testTimeline.eventWriter(events)
 		}
 		podlogs.CopyAllLogs(ctx, cs, ns.Name, to)
-		podlogs.WatchPods(ctx, cs, ns.Name, GinkgoWriter)
+		podlogs.WatchPods(ctx, cs, ns.Name, events)
 	})
 
 	AfterEach(func() {
 		cancel()
+		if eventsFile != nil {
+			eventsFile.Close()
+			eventsFile = nil
+		}
+		if podLogFiles != nil {
+			podLogFiles.Close()
+			podLogFiles = nil
+		}
+		if podLogs != nil {
+			if CurrentGinkgoTestDescription().Failed {
+				podLogs.dump()
+			}
+			podLogs = nil
+		}
+		if testTimeline != nil {
+			// With -csi.pod-logs=on-failure, the timeline
+			// is also only needed for failed tests.
+			testTimeline.finish(csiTestContext.podLogs != podLogsOnFailure || CurrentGinkgoTestDescription().Failed)
+			testTimeline = nil
+		}
+		// This AfterEach runs after the one of the framework,
+		// so the test namespace is already gone.
+		leaks.afterTest()
 	})
 
 	// List of test drivers to be tested against.
-	var csiTestDrivers = []func() testdriver.TestDriver{
+	var csiTestDrivers = []func() *manifestDriver{
 		// hostpath driver
-		func() testdriver.TestDriver {
+		func() *manifestDriver {
 			return &manifestDriver{
 				driverInfo: testdriver.DriverInfo{
 					Name:        "csi-hostpath",
@@ -128,6 +192,49 @@ var _ = Describe("CSI Volumes", func() {
 					ProvisionerContainerName: "csi-provisioner",
 				},
 				claimSize: "1Mi",
+				driverPods: driverPodLabels{
+					provisioner: "csi-hostpath-provisioner",
+					attacher:    "csi-hostpath-attacher",
+					plugin:      "csi-hostpathplugin",
+				},
+				csiSocket:      "/csi/csi.sock",
+				sanityMountDir: "/csi/sanity",
+
+				restartLosesData: true,
+
+				// CreateVolume uses the requested size without
+				// rounding and rejects sizes of 1Ti and more. The
+				// external-provisioner v0.4.1 rounds the PV
+				// capacity up to whole Gi.
+				capacity: &driverCapacity{
+					maximum:       1024*1024*1024*1024 - 1,
+					pvGranularity: 1024 * 1024 * 1024,
+				},
+
+				// The images in the manifests are from v0.4.1.
+				upgrade: &driverUpgrade{
+					from: driverVersion{
+						name: "v0.4.0",
+						images: map[string]string{
+							"hostpath":         "quay.io/k8scsi/hostpathplugin:v0.4.0",
+							"driver-registrar": "quay.io/k8scsi/driver-registrar:v0.4.0",
+							"csi-provisioner":  "quay.io/k8scsi/csi-provisioner:v0.4.0",
+							"csi-attacher":     "quay.io/k8scsi/csi-attacher:v0.4.0",
+						},
+					},
+					to: driverVersion{
+						name: "v0.4.1",
+					},
+				},
+
+				// The hostpath driver stores each volume in a
+				// directory inside the plugin container.
+				volumeExists: func(m *manifestDriver, volumeHandle string) bool {
+					f := m.driverInfo.Config.Framework
+					pod := getDriverPod(m, m.driverPods.plugin)
+					_, _, err := f.ExecCommandInContainerWithFullOutput(pod.Name, "hostpath", "test", "-d", "/tmp/"+volumeHandle)
+					return err == nil
+				},
 
 				// The actual node on which the driver and the test pods run must
 				// be set at runtime because it cannot be determined in advance.
@@ -151,6 +258,28 @@ var _ = Describe("CSI Volumes", func() {
 		testsuites.InitProvisioningTestSuite,
 	}
 
+	// List of CSI-specific test suites from this package to be
+	// executed for each driver.
+	var csiDriverTestSuites = []func() csiTestSuite{
+		initAttachLimitTestSuite,
+		initReclaimPolicyTestSuite,
+		initAccessModesTestSuite,
+		initDisruptionTestSuite,
+		initKubeletRestartTestSuite,
+		initRegistrationTestSuite,
+		initVolumeStatsTestSuite,
+		initSecretsTestSuite,
+		initFaultInjectionTestSuite,
+		initSanityTestSuite,
+		initPersistenceTestSuite,
+		initProtectionTestSuite,
+		initReadOnlyTestSuite,
+		initCapacityTestSuite,
+		initUpgradeTestSuite,
+		initStatefulSetTestSuite,
+		initBenchmarkTestSuite,
+	}
+
 	for _, initDriver := range csiTestDrivers {
 		curDriver := initDriver()
 		Context(testsuites.GetDriverNameWithFeatureTags(curDriver), func() {
@@ -162,11 +291,15 @@ var _ = Describe("CSI Volumes", func() {
 			})
 
 			AfterEach(func() {
+				// Collect the state of failed tests, unless
+				// already done before the test cleaned up.
+				saveDiagnostics(driver)
 				// Cleanup driver
 				driver.CleanupDriver()
 			})
 
 			testsuites.RunTestSuite(f, driver, csiTestSuites, csiTunePattern)
+			runCSITestSuites(driver, csiDriverTestSuites, csiTunePattern)
 		})
 	}
 })
@@ -185,6 +318,89 @@ type manifestDriver struct {
 	claimSize    string
 	beforeEach   func(m *manifestDriver)
 	cleanup      func()
+
+	// Removes the driver in the AfterSuite cleanup when the
+	// test run gets interrupted.
+	cleanupHandle framework.CleanupActionHandle
+
+	// The maximum number of volumes per node. If zero, the limit
+	// reported by the driver via NodeGetInfo is used.
+	attachLimit int
+
+	// Checks whether the volume with the given handle exists in
+	// the storage backend. Tests which need this get skipped
+	// when it is not set.
+	volumeExists func(m *manifestDriver, volumeHandle string) bool
+
+	// The access modes supported by the driver in addition to
+	// ReadWriteOnce, which is always assumed to be supported.
+	accessModes []v1.PersistentVolumeAccessMode
+
+	// The "app" labels of the pods created by the manifests.
+	driverPods driverPodLabels
+
+	// The topology keys that the driver reports in NodeGetInfo.
+	topologyKeys []string
+
+	// Maps a node name to the node ID that the driver reports
+	// for that node. If nil, the node name is expected.
+	nodeID func(nodeName string) string
+
+	// Whether the driver implements NodeGetVolumeStats. The
+	// hostpath driver does not.
+	volumeStats bool
+
+	// Secrets which get created together with the driver and
+	// are referenced in the StorageClass parameters.
+	secrets []driverSecret
+
+	// The path of the CSI socket inside the driver container.
+	// Must be set for deploying the fault injection proxy.
+	csiSocket string
+
+	// A directory inside the driver container in which the
+	// sanity checks create staging and target paths. It must be
+	// below the directory of csiSocket because the sanity helper
+	// pod creates and removes it. Node checks which publish
+	// volumes get skipped when it is empty, for example for
+	// drivers which can only mount into kubelet directories.
+	sanityMountDir string
+
+	// Set for drivers which keep volume data inside their own
+	// pods, like the hostpath driver does in /tmp of the plugin
+	// container. Data then does not survive a restart of the
+	// driver, the persistence test for that gets skipped and the
+	// disruption test mounts a new volume after restarting the
+	// node plugin.
+	restartLosesData bool
+
+	// The volume sizes supported by the driver. The capacity
+	// suite gets skipped when not set.
+	capacity *driverCapacity
+
+	// Two versions of the driver for the upgrade suite, which
+	// gets skipped when not set.
+	upgrade *driverUpgrade
+
+	// If set, CreateDriver deploys this version instead of the
+	// default manifests.
+	version *driverVersion
+
+	// Set once the diagnostics of a failed test were saved, so
+	// that the different AfterEach hooks only save them once.
+	diagnosticsSaved bool
+}
+
+// driverPodLabels contains the values of the "app" label of the
+// different pods in a driver deployment. Tests which need to find
+// one of these pods get skipped when the value is empty.
+type driverPodLabels struct {
+	// The StatefulSet pod with the external-provisioner.
+	provisioner string
+	// The StatefulSet pod with the external-attacher.
+	attacher string
+	// The DaemonSet pod with the driver and driver-registrar.
+	plugin string
 }
 
 var _ testdriver.TestDriver = &manifestDriver{}
@@ -207,6 +423,12 @@ func (m *manifestDriver) GetDynamicProvisionStorageClass(fsType string) *storage
 
 	sc, ok := items[0].(*storagev1.StorageClass)
 	Expect(ok).To(BeTrue(), "storage class from %s", m.scManifest)
+	for key, value := range m.secretParameters() {
+		if sc.Parameters == nil {
+			sc.Parameters = map[string]string{}
+		}
+		sc.Parameters[key] = value
+	}
 	return sc
 }
 
@@ -217,19 +439,44 @@ func (m *manifestDriver) GetClaimSize() string {
 	return m.claimSize
 }
 
+// supportsAccessMode checks whether the driver is configured to
+// support the access mode.
+func (m *manifestDriver) supportsAccessMode(mode v1.PersistentVolumeAccessMode) bool {
+	if mode == v1.ReadWriteOnce {
+		return true
+	}
+	for _, supported := range m.accessModes {
+		if supported == mode {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *manifestDriver) CreateDriver() {
 	By(fmt.Sprintf("deploying %s driver", m.driverInfo.Name))
+	m.diagnosticsSaved = false
 	if m.beforeEach != nil {
 		m.beforeEach(m)
 	}
 	f := m.driverInfo.Config.Framework
 
-	cleanup, err := f.CreateFromManifests(func(item interface{}) error {
-		return utils.PatchCSIDeployment(f, m.finalPatchOptions(), item)
-	},
-		m.manifests...,
-	)
-	m.cleanup = cleanup
+	// Secrets are created first because the driver might need
+	// them as soon as it runs.
+	secretsCleanup, err := m.createSecrets()
+	if err != nil {
+		framework.Failf("creating secrets for %s driver: %v", m.driverInfo.Name, err)
+	}
+	cleanup, err := f.CreateFromManifests(m.patchItem, m.manifestFiles()...)
+	m.cleanup = func() {
+		if cleanup != nil {
+			cleanup()
+		}
+		secretsCleanup()
+	}
+	// Also remove the driver when the test run gets
+	// interrupted.
+	m.cleanupHandle = framework.AddCleanupAction(m.CleanupDriver)
 	if err != nil {
 		framework.Failf("deploying csi hostpath driver: %v", err)
 	}
@@ -237,9 +484,52 @@ func (m *manifestDriver) CreateDriver() {
 
 func (m *manifestDriver) CleanupDriver() {
 	if m.cleanup != nil {
+		if m.hasCSIProxy() {
+			saveProxyTrace(m)
+		}
+		recordSoakSamples(m)
 		By(fmt.Sprintf("uninstalling %s driver", m.driverInfo.Name))
+		framework.RemoveCleanupAction(m.cleanupHandle)
 		m.cleanup()
+		m.cleanup = nil
+	}
+}
+
+// patchItem gets applied to all items from the driver manifests
+// after the generic patching by the framework.
+func (m *manifestDriver) patchItem(item interface{}) error {
+	f := m.driverInfo.Config.Framework
+	if err := utils.PatchCSIDeployment(f, m.finalPatchOptions(), item); err != nil {
+		return err
 	}
+	m.patchImages(item)
+	return m.patchCSIProxy(item)
+}
+
+// getPodSpec returns the pod template spec of a DaemonSet,
+// StatefulSet or Deployment, nil for other items.
+func getPodSpec(item interface{}) *v1.PodSpec {
+	switch item := item.(type) {
+	case *appsv1.DaemonSet:
+		return &item.Spec.Template.Spec
+	case *appsv1.StatefulSet:
+		return &item.Spec.Template.Spec
+	case *appsv1.Deployment:
+		return &item.Spec.Template.Spec
+	}
+	return nil
+}
+
+// reinstallDriver uninstalls the driver and deploys it again on the
+// same node, without calling beforeEach again.
+func (m *manifestDriver) reinstallDriver() {
+	m.CleanupDriver()
+	beforeEach := m.beforeEach
+	m.beforeEach = nil
+	defer func() {
+		m.beforeEach = beforeEach
+	}()
+	m.CreateDriver()
 }
 
 func (m *manifestDriver) finalPatchOptions() utils.PatchCSIOptions {